@@ -1,17 +1,25 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
+	"github.com/freikugel0/boorumesh-be/internal/cache"
 	httpTransport "github.com/freikugel0/boorumesh-be/internal/http"
 	"github.com/freikugel0/boorumesh-be/internal/http/handler"
+	"github.com/freikugel0/boorumesh-be/internal/media"
 	"github.com/freikugel0/boorumesh-be/internal/repository/postgres"
+	"github.com/freikugel0/boorumesh-be/internal/secret"
 	"github.com/freikugel0/boorumesh-be/internal/service"
 )
 
@@ -25,16 +33,87 @@ func main() {
 	}
 	defer db.Close()
 
+	// Secrets: key for encrypting source auth at rest (optional until a
+	// source uses auth)
+	var box *secret.Box
+	if rawKey := os.Getenv("SOURCE_SECRET_KEY"); rawKey != "" {
+		key, err := secret.ParseKey(rawKey)
+		if err != nil {
+			log.Fatalf("SOURCE_SECRET_KEY: %v", err)
+		}
+		if box, err = secret.NewBox(key); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Repo
-	srcRepo := postgres.NewSourceRepositoryPostgres(db)
+	srcRepo := postgres.NewSourceRepositoryPostgres(db, box)
+
+	// Upstream response cache: memory (default), postgres or none
+	var respCache cache.Cache
+	switch backend := os.Getenv("CACHE_BACKEND"); backend {
+	case "", "memory":
+		respCache = cache.NewMemoryLRU()
+	case "postgres":
+		respCache = postgres.NewUpstreamCachePostgres(db)
+	case "none":
+	default:
+		log.Fatalf("unknown CACHE_BACKEND %q", backend)
+	}
+
+	// Media proxy URLs: signed with MEDIA_SIGNING_KEY, still accepting
+	// MEDIA_SIGNING_KEYS_PREVIOUS after a rotation; PUBLIC_BASE_URL makes
+	// them absolute (optional). Without a key the media proxy is off, unless
+	// MEDIA_SIGNING_KEY_RANDOM=1 allows a throwaway key for local development
+	signer, err := mediaSigner(
+		os.Getenv("MEDIA_SIGNING_KEY"),
+		os.Getenv("MEDIA_SIGNING_KEYS_PREVIOUS"),
+		os.Getenv("MEDIA_SIGNING_KEY_RANDOM") == "1",
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mediaTTL := 24 * time.Hour
+	if raw := os.Getenv("MEDIA_URL_TTL"); raw != "" {
+		if mediaTTL, err = time.ParseDuration(raw); err != nil || mediaTTL <= 0 {
+			log.Fatalf("MEDIA_URL_TTL: invalid duration %q", raw)
+		}
+	}
+	var mediaURLs *media.URLBuilder
+	if signer != nil {
+		mediaURLs = media.NewURLBuilder(os.Getenv("PUBLIC_BASE_URL"), signer, mediaTTL)
+	} else {
+		log.Print("MEDIA_SIGNING_KEY not set; media proxy disabled")
+	}
+
+	// Media disk cache: MEDIA_CACHE_DIR enables it, MEDIA_CACHE_MAX_BYTES
+	// is its size budget (optional)
+	var mediaCache *media.DiskCache
+	if dir := os.Getenv("MEDIA_CACHE_DIR"); dir != "" {
+		maxBytes := int64(1 << 30)
+		if raw := os.Getenv("MEDIA_CACHE_MAX_BYTES"); raw != "" {
+			if maxBytes, err = strconv.ParseInt(raw, 10, 64); err != nil || maxBytes <= 0 {
+				log.Fatalf("MEDIA_CACHE_MAX_BYTES: invalid size %q", raw)
+			}
+		}
+		if mediaCache, err = media.NewDiskCache(dir, maxBytes); err != nil {
+			log.Fatalf("MEDIA_CACHE_DIR: %v", err)
+		}
+	}
 
 	// Services
-	devSourceSvc := service.NewDevSourceService(srcRepo)
-	sourceFetchSvc := service.NewSourceFetchService(srcRepo)
+	sourceFetchSvc := service.NewSourceFetchService(srcRepo, respCache, mediaURLs)
+	devSourceSvc := service.NewDevSourceService(srcRepo, sourceFetchSvc, signer != nil)
+	mediaSvc := service.NewMediaService(srcRepo, mediaCache)
 
 	// Handlers
 	devSourceHandler := handler.NewDevSourceHandler(devSourceSvc)
-	apiHandler := handler.NewApiHandler(sourceFetchSvc)
+	// ADMIN_TOKEN unlocks admin-only response details (optional)
+	apiHandler := handler.NewApiHandler(sourceFetchSvc, os.Getenv("ADMIN_TOKEN"))
+	var mediaHandler *handler.MediaHandler
+	if signer != nil {
+		mediaHandler = handler.NewMediaHandler(mediaSvc, signer)
+	}
 
 	// Router
 	port := os.Getenv("PORT")
@@ -42,8 +121,43 @@ func main() {
 		port = "8080"
 	}
 
-	r := httpTransport.NewRouter(devSourceHandler, apiHandler)
+	r := httpTransport.NewRouter(devSourceHandler, apiHandler, mediaHandler)
 	if err := r.Run(":" + port); err != nil {
 		log.Fatalf("failed to start server: %v", err)
 	}
 }
+
+// mediaSigner builds the media URL signer from a current key and a
+// comma-separated list of previous ones. Without a current key it returns
+// nil, unless allowRandom is set, in which case a random one is used and
+// media URLs stop working when the process restarts.
+func mediaSigner(current, previous string, allowRandom bool) (*media.Signer, error) {
+	if strings.TrimSpace(current) == "" {
+		if !allowRandom {
+			return nil, nil
+		}
+		log.Print("MEDIA_SIGNING_KEY not set; using a random key for this process")
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return media.NewSigner(key), nil
+	}
+
+	key, err := secret.ParseKey(current)
+	if err != nil {
+		return nil, fmt.Errorf("MEDIA_SIGNING_KEY: %w", err)
+	}
+	var old [][]byte
+	for _, raw := range strings.Split(previous, ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		k, err := secret.ParseKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("MEDIA_SIGNING_KEYS_PREVIOUS: %w", err)
+		}
+		old = append(old, k)
+	}
+	return media.NewSigner(key, old...), nil
+}
@@ -0,0 +1,196 @@
+package breaker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half_open"
+)
+
+type Config struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker.
+	FailureThreshold int
+	// OpenFor is how long the breaker stays open before letting a probe through.
+	OpenFor time.Duration
+}
+
+// Breaker is a consecutive-failure circuit breaker. While open every call is
+// rejected; after OpenFor a single probe is let through (half-open) and its
+// outcome closes or re-opens the breaker.
+type Breaker struct {
+	mu            sync.Mutex
+	cfg           Config
+	state         State
+	failures      int
+	openedAt      time.Time
+	probing       bool
+	lastError     string
+	lastFailureAt time.Time
+}
+
+func New(cfg Config) *Breaker {
+	return &Breaker{cfg: cfg, state: StateClosed}
+}
+
+// Allow reports whether a call may proceed. When it may not, it returns how
+// long until the breaker will let a probe through.
+func (b *Breaker) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		reopenAt := b.openedAt.Add(b.cfg.OpenFor)
+		if wait := time.Until(reopenAt); wait > 0 {
+			return false, wait
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+		return true, 0
+	case StateHalfOpen:
+		if b.probing {
+			return false, b.cfg.OpenFor
+		}
+		b.probing = true
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// Success records a healthy call and closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = StateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed call, opening the breaker when the threshold is
+// reached or when a half-open probe fails. Failures while it is open come
+// from calls started before it opened and don't extend the open period.
+func (b *Breaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen {
+		return
+	}
+	b.failures++
+	b.lastFailureAt = time.Now()
+	if err != nil {
+		b.lastError = err.Error()
+	}
+
+	if b.state == StateHalfOpen || b.failures >= b.cfg.FailureThreshold {
+		b.state = StateOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// Ignore releases a call whose outcome says nothing about upstream health,
+// e.g. one cancelled by the client.
+func (b *Breaker) Ignore() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *Breaker) configure(cfg Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg
+}
+
+// Snapshot is a point-in-time view of a breaker.
+type Snapshot struct {
+	Key                 string     `json:"key"`
+	State               State      `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	FailureThreshold    int        `json:"failure_threshold"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+}
+
+func (b *Breaker) snapshot(key string) Snapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := Snapshot{
+		Key:                 key,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		FailureThreshold:    b.cfg.FailureThreshold,
+		LastError:           b.lastError,
+	}
+	if b.state != StateClosed {
+		opened := b.openedAt
+		retry := opened.Add(b.cfg.OpenFor)
+		s.OpenedAt, s.RetryAt = &opened, &retry
+	}
+	if !b.lastFailureAt.IsZero() {
+		t := b.lastFailureAt
+		s.LastFailureAt = &t
+	}
+	return s
+}
+
+// Registry keeps one breaker per key (a source code).
+type Registry struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func NewRegistry() *Registry {
+	return &Registry{breakers: map[string]*Breaker{}}
+}
+
+// Get returns the breaker for key, applying cfg if it changed.
+func (r *Registry) Get(key string, cfg Config) *Breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.breakers[key]
+	if !ok {
+		b = New(cfg)
+		r.breakers[key] = b
+		return b
+	}
+	b.configure(cfg)
+	return b
+}
+
+// Snapshot returns the state of every breaker, ordered by key.
+func (r *Registry) Snapshot() []Snapshot {
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.breakers))
+	for k := range r.breakers {
+		keys = append(keys, k)
+	}
+	breakers := make([]*Breaker, 0, len(keys))
+	sort.Strings(keys)
+	for _, k := range keys {
+		breakers = append(breakers, r.breakers[k])
+	}
+	r.mu.Unlock()
+
+	out := make([]Snapshot, 0, len(keys))
+	for i, b := range breakers {
+		out = append(out, b.snapshot(keys[i]))
+	}
+	return out
+}
@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Options control how a single entry is stored. Entries are grouped by
+// Namespace (the source code) so each source gets its own size budget.
+type Options struct {
+	Namespace  string
+	TTL        time.Duration
+	MaxEntries int // per namespace; 0 means the backend default
+}
+
+// Cache stores opaque values, typically raw upstream response bodies.
+type Cache interface {
+	// Get returns the value for key, or false if it is missing or expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, opts Options) error
+}
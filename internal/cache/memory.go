@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultMaxEntries = 1000
+
+// MemoryLRU is an in-process cache with one LRU list per namespace.
+type MemoryLRU struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	namespaces map[string]*list.List
+}
+
+type memoryEntry struct {
+	key       string
+	namespace string
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewMemoryLRU() *MemoryLRU {
+	return &MemoryLRU{
+		entries:    map[string]*list.Element{},
+		namespaces: map[string]*list.List{},
+	}
+}
+
+func (c *MemoryLRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*memoryEntry)
+	if time.Now().After(e.expiresAt) {
+		c.remove(el)
+		return nil, false, nil
+	}
+
+	c.namespaces[e.namespace].MoveToFront(el)
+	return e.value, true, nil
+}
+
+func (c *MemoryLRU) Set(ctx context.Context, key string, value []byte, opts Options) error {
+	if opts.TTL <= 0 {
+		return nil
+	}
+	maxEntries := opts.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	lru, ok := c.namespaces[opts.Namespace]
+	if !ok {
+		lru = list.New()
+		c.namespaces[opts.Namespace] = lru
+	}
+	c.entries[key] = lru.PushFront(&memoryEntry{
+		key:       key,
+		namespace: opts.Namespace,
+		value:     value,
+		expiresAt: time.Now().Add(opts.TTL),
+	})
+
+	for lru.Len() > maxEntries {
+		c.remove(lru.Back())
+	}
+
+	return nil
+}
+
+func (c *MemoryLRU) remove(el *list.Element) {
+	e := el.Value.(*memoryEntry)
+	lru := c.namespaces[e.namespace]
+	lru.Remove(el)
+	delete(c.entries, e.key)
+	if lru.Len() == 0 {
+		delete(c.namespaces, e.namespace)
+	}
+}
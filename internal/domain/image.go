@@ -11,6 +11,14 @@ const (
 	RatingQuestionable Rating = "q"
 )
 
+func (r Rating) Valid() bool {
+	switch r {
+	case RatingExplicit, RatingSensitive, RatingGeneral, RatingQuestionable:
+		return true
+	}
+	return false
+}
+
 type Image struct {
 	ID          string     `json:"id"`
 	Upstream    SourceCode `json:"upstream"`
@@ -21,7 +29,18 @@ type Image struct {
 	HasChildren bool       `json:"has_children"`
 	ParentID    *string    `json:"parent_id"`
 	MD5         string     `json:"md5"`
+	Score       *int       `json:"score,omitempty"`
 	PreviewURL  string     `json:"preview_url,omitempty"`
 	SampleURL   string     `json:"sample_url,omitempty"`
 	FileURL     string     `json:"file_url"`
+	// Warnings lists non-fatal mapping problems, e.g. an unrecognised rating.
+	Warnings []string `json:"warnings,omitempty"`
+	// AlsoOn lists other sources with the same image (by MD5) in merged results.
+	AlsoOn []ImageRef `json:"also_on,omitempty"`
+}
+
+// ImageRef points at an image on a specific source.
+type ImageRef struct {
+	Upstream SourceCode `json:"upstream"`
+	ID       string     `json:"id"`
 }
@@ -1,18 +1,91 @@
 package domain
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type SourceCode string
 
+type TransformOp string
+
+const (
+	TransformTrim         TransformOp = "trim" // trim whitespace, or the characters in Value
+	TransformLowercase    TransformOp = "lowercase"
+	TransformUppercase    TransformOp = "uppercase"
+	TransformRegexReplace TransformOp = "regex_replace" // Pattern → Replace ($1 etc. allowed)
+	TransformPrefix       TransformOp = "prefix"        // Value + v
+	TransformSuffix       TransformOp = "suffix"        // v + Value
+	TransformTemplate     TransformOp = "template"      // Value with {value}, {base_url}, {source}, {<path>}
+	TransformMap          TransformOp = "map"           // Map[v], unmapped values pass through
+)
+
+// Named values for FieldMapping.Format; anything else is a Go time layout
+// such as "Mon Jan 02 15:04:05 -0700 2006".
+const (
+	TimeFormatUnix    = "unix"
+	TimeFormatUnixMS  = "unix_ms"
+	TimeFormatRFC3339 = "rfc3339" // also accepts fractional seconds
+)
+
+// FieldTransform is one step of a field's value pipeline.
+type FieldTransform struct {
+	Op      TransformOp       `json:"op"`
+	Pattern string            `json:"pattern,omitempty"`
+	Replace string            `json:"replace,omitempty"`
+	Value   string            `json:"value,omitempty"`
+	Map     map[string]string `json:"map,omitempty"`
+}
+
 type FieldMapping struct {
-	Key   string `json:"key"`
-	Split string `json:"split,omitempty"`
+	// Key is a path into the upstream record: "file_url", "file.url",
+	// "tags.general[]", "tags.*", "representations.thumb", ...
+	// It may be left empty for fields built purely from a template.
+	Key string `json:"key"`
+	// Split breaks string values into several (e.g. "," for comma-separated
+	// tags). Tag strings are split on whitespace when unset.
+	Split      string           `json:"split,omitempty"`
+	Transforms []FieldTransform `json:"transforms,omitempty"`
+	// Format tells time fields how to parse the value (see TimeFormat*).
+	// When empty common layouts and unix timestamps are detected.
+	Format string `json:"format,omitempty"`
 }
 
 type SourceMapping struct {
 	Fields map[string]FieldMapping `json:"fields"`
+	// Ratings maps upstream rating values (case-insensitive) to domain
+	// ratings, e.g. {"s": "g"} for older boorus where "s" means safe.
+	// When empty the built-in e/q/s/g map is used.
+	Ratings map[string]Rating `json:"ratings,omitempty"`
+	// RatingFallback is used for values Ratings does not know; when empty
+	// such images are left unrated. Either way the image gets a warning.
+	RatingFallback Rating `json:"rating_fallback,omitempty"`
+	// ProxyMedia rewrites file, sample and preview URLs to go through the
+	// media proxy (see RequestConfig.MediaHosts).
+	ProxyMedia bool `json:"proxy_media,omitempty"`
 }
 
+type ResponseFormat string
+
+const (
+	ResponseFormatJSON ResponseFormat = "json"
+	ResponseFormatXML  ResponseFormat = "xml"
+)
+
+type PaginationStyle string
+
+const (
+	// PaginationPage sends a page number counted from Capabilities.PageBase.
+	PaginationPage PaginationStyle = "page"
+	// PaginationPID sends a 0-based page index, like Gelbooru's pid.
+	PaginationPID PaginationStyle = "pid"
+	// PaginationOffset sends the number of posts to skip.
+	PaginationOffset PaginationStyle = "offset"
+	// PaginationCursor sends page numbers, or b<id>/a<id> (posts before or
+	// after an id) when clients page with cursors, like Danbooru.
+	PaginationCursor PaginationStyle = "cursor"
+)
+
 type RequestConfig struct {
 	PostsPath  string            `json:"posts_path"`
 	TagsParam  string            `json:"tags_param"`
@@ -20,23 +93,232 @@ type RequestConfig struct {
 	PageParam  string            `json:"page_param"`
 	ExtraQuery map[string]string `json:"extra_query,omitempty"`
 	Headers    map[string]string `json:"headers,omitempty"`
+	// ResponseRoot is the path to the post array when the upstream wraps it
+	// in an envelope, e.g. "posts" (e621), "post" (Gelbooru) or "images"
+	// (Philomena). Empty means the body itself is the array.
+	ResponseRoot string `json:"response_root,omitempty"`
+	// TotalPath optionally points at the total result count inside the
+	// envelope, e.g. "total" or "@attributes.count".
+	TotalPath string `json:"total_path,omitempty"`
+	// ResponseFormat selects how the upstream body is decoded; defaults to
+	// json. With xml, elements become objects whose attributes and child
+	// elements are keys, so mappings are written the same way as for json.
+	ResponseFormat ResponseFormat `json:"response_format,omitempty"`
+	// PostPath is the single-post endpoint with {id} standing in for the
+	// post ID, e.g. "/posts/{id}.json". Sources without one can instead set
+	// PostIDParam to look posts up through PostsPath, e.g. Gelbooru's "id".
+	PostPath    string `json:"post_path,omitempty"`
+	PostIDParam string `json:"post_id_param,omitempty"`
+	// PostRoot is the path to the post object in a PostPath response, e.g.
+	// "post" (e621). Empty means the body is the post. PostIDParam lookups
+	// are unwrapped with ResponseRoot like searches.
+	PostRoot string `json:"post_root,omitempty"`
+	// Pagination is how PageParam is filled in; defaults to page.
+	Pagination PaginationStyle `json:"pagination,omitempty"`
+	// MediaHeaders are sent when the media proxy fetches files, e.g. the
+	// Referer or User-Agent a CDN insists on.
+	MediaHeaders map[string]string `json:"media_headers,omitempty"`
+	// MediaHosts is the media proxy's allowlist; "*.example.com" also
+	// matches subdomains. Empty disables the proxy for the source.
+	MediaHosts []string `json:"media_hosts,omitempty"`
+	// MediaMaxBytes caps the size of proxied files; defaults to 64 MiB.
+	MediaMaxBytes int64 `json:"media_max_bytes,omitempty"`
+}
+
+type RateLimitMode string
+
+const (
+	// RateLimitWait queues over-limit requests until MaxWaitMS.
+	RateLimitWait RateLimitMode = "wait"
+	// RateLimitReject fails over-limit requests immediately.
+	RateLimitReject RateLimitMode = "reject"
+)
+
+// RateLimitConfig is a token bucket for outbound requests to a source.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"rps"`
+	// Burst defaults to ceil(rps).
+	Burst int `json:"burst,omitempty"`
+	// PerHost shares the bucket with every source on the same upstream host.
+	PerHost bool          `json:"per_host,omitempty"`
+	Mode    RateLimitMode `json:"mode,omitempty"`
+	// MaxWaitMS bounds queueing in wait mode; defaults to the source timeout.
+	MaxWaitMS int `json:"max_wait_ms,omitempty"`
+}
+
+// RetryPolicy controls retries of failed upstream calls.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt; 0 or 1 disables retries.
+	MaxAttempts int `json:"max_attempts"`
+	// RetryStatuses defaults to 429, 502, 503 and 504. Transport errors and
+	// timeouts are always retried.
+	RetryStatuses []int `json:"retry_statuses,omitempty"`
+	// BaseDelayMS and MaxDelayMS bound the exponential backoff (with jitter);
+	// defaults are 200ms and 5s.
+	BaseDelayMS int `json:"base_delay_ms,omitempty"`
+	MaxDelayMS  int `json:"max_delay_ms,omitempty"`
+	// RespectRetryAfter waits at least as long as the upstream's Retry-After.
+	RespectRetryAfter bool `json:"respect_retry_after,omitempty"`
+}
+
+// BreakerConfig tunes the per-source circuit breaker.
+type BreakerConfig struct {
+	// FailureThreshold is how many consecutive failures open it (default 5).
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// OpenMS is how long it stays open before a probe is let through (default 30s).
+	OpenMS int `json:"open_ms,omitempty"`
 }
 
 type SourceDefaults struct {
 	TagsSuffix string `json:"tags_suffix,omitempty"`
 	MaxLimit   int    `json:"max_limit,omitempty"`
 	TimeoutMS  int    `json:"timeout_ms,omitempty"`
+	// CacheTTLMS enables response caching for this source; 0 disables it.
+	CacheTTLMS int `json:"cache_ttl_ms,omitempty"`
+	// CacheMaxEntries caps how many responses of this source are kept.
+	CacheMaxEntries int `json:"cache_max_entries,omitempty"`
+	// RateLimit throttles outbound requests; nil means unlimited.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	Retry     *RetryPolicy     `json:"retry,omitempty"`
+	Breaker   *BreakerConfig   `json:"breaker,omitempty"`
+	// Priority decides which copy of a duplicate image is kept in merged
+	// results; higher wins.
+	Priority int `json:"priority,omitempty"`
+}
+
+type AuthScheme string
+
+const (
+	// AuthBasic sends Username/Password as HTTP Basic auth.
+	AuthBasic AuthScheme = "basic"
+	// AuthQuery sends Username in UserParam and Token in KeyParam, e.g.
+	// Danbooru's login/api_key or Gelbooru's user_id/api_key.
+	AuthQuery AuthScheme = "query"
+	// AuthBearer sends "Authorization: Bearer <Token>".
+	AuthBearer AuthScheme = "bearer"
+	// AuthHeader sends Token in the HeaderName header.
+	AuthHeader AuthScheme = "header"
+)
+
+// RedactedValue replaces secrets in API responses. Sending it back in an
+// update keeps the stored secret.
+const RedactedValue = "[redacted]"
+
+// SourceAuth holds upstream credentials. It is stored encrypted and never
+// returned in clear text by the dev API.
+type SourceAuth struct {
+	Scheme     AuthScheme `json:"scheme"`
+	Username   string     `json:"username,omitempty"`
+	Password   string     `json:"password,omitempty"`
+	Token      string     `json:"token,omitempty"`
+	UserParam  string     `json:"user_param,omitempty"`
+	KeyParam   string     `json:"key_param,omitempty"`
+	HeaderName string     `json:"header_name,omitempty"`
+}
+
+// QueryDialect names the search syntax a source's API understands.
+type QueryDialect string
+
+const (
+	DialectDanbooru QueryDialect = "danbooru"
+	DialectGelbooru QueryDialect = "gelbooru"
+	DialectMoebooru QueryDialect = "moebooru"
+	DialectE621     QueryDialect = "e621"
+)
+
+// SourceCapabilities declares which parts of the unified query language a
+// source can express upstream. Anything it cannot express is applied to the
+// mapped images instead.
+type SourceCapabilities struct {
+	Dialect  QueryDialect `json:"dialect"`
+	Negation bool         `json:"negation,omitempty"`
+	Or       bool         `json:"or,omitempty"`
+	Rating   bool         `json:"rating,omitempty"`
+	Score    bool         `json:"score,omitempty"`
+	Sort     bool         `json:"sort,omitempty"`
+	Wildcard bool         `json:"wildcard,omitempty"`
+	// MaxTags caps the tags sent upstream (metatags such as rating: don't
+	// count); 0 means no limit. Tags over the cap are post-filtered.
+	MaxTags int `json:"max_tags,omitempty"`
+	// PageBase is the upstream number of the first page, 0 or 1 (default).
+	PageBase *int `json:"page_base,omitempty"`
+	// MaxPage is the deepest page the upstream serves; 0 means no limit.
+	MaxPage int `json:"max_page,omitempty"`
+	// Strict rejects queries with clauses the source can't express instead
+	// of post-filtering them.
+	Strict bool `json:"strict,omitempty"`
+}
+
+// FirstPage returns the upstream number of the first page.
+func (c SourceCapabilities) FirstPage() int {
+	if c.PageBase == nil {
+		return 1
+	}
+	return *c.PageBase
 }
 
 type Source struct {
-	ID        int64          `json:"id"`
-	Code      SourceCode     `json:"code"`
-	Name      string         `json:"name"`
-	BaseURL   string         `json:"base_url"`
-	Enabled   bool           `json:"enabled"`
-	Request   RequestConfig  `json:"request"`
-	Mapping   SourceMapping  `json:"mapping"`
-	Defaults  SourceDefaults `json:"defaults"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
+	ID       int64          `json:"id"`
+	Code     SourceCode     `json:"code"`
+	Name     string         `json:"name"`
+	BaseURL  string         `json:"base_url"`
+	Enabled  bool           `json:"enabled"`
+	Request  RequestConfig  `json:"request"`
+	Mapping  SourceMapping  `json:"mapping"`
+	Defaults SourceDefaults `json:"defaults"`
+	Auth     *SourceAuth    `json:"auth,omitempty"`
+	// AuthError is set when the stored auth could not be decrypted, e.g.
+	// after SOURCE_SECRET_KEY changed. Such a source can't be fetched from
+	// until its auth is saved again.
+	AuthError string `json:"auth_error,omitempty"`
+	// Capabilities is nil for sources that take the query verbatim.
+	Capabilities *SourceCapabilities `json:"capabilities,omitempty"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+	DeletedAt    *time.Time          `json:"deleted_at,omitempty"`
+}
+
+// Redacted returns a copy of the source that is safe to show: auth secrets
+// and credential-looking headers are replaced with RedactedValue.
+func (s Source) Redacted() Source {
+	if s.Auth != nil {
+		auth := *s.Auth
+		if auth.Password != "" {
+			auth.Password = RedactedValue
+		}
+		if auth.Token != "" {
+			auth.Token = RedactedValue
+		}
+		s.Auth = &auth
+	}
+
+	s.Request.Headers = redactHeaders(s.Request.Headers)
+	s.Request.MediaHeaders = redactHeaders(s.Request.MediaHeaders)
+
+	return s
+}
+
+func redactHeaders(in map[string]string) map[string]string {
+	if len(in) == 0 {
+		return in
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		if IsSensitiveHeader(k) {
+			v = RedactedValue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// IsSensitiveHeader reports whether a header name usually carries credentials.
+func IsSensitiveHeader(name string) bool {
+	n := strings.ToLower(name)
+	switch n {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	return strings.Contains(n, "token") || strings.Contains(n, "api-key") ||
+		strings.Contains(n, "apikey") || strings.Contains(n, "secret")
 }
@@ -2,20 +2,27 @@ package handler
 
 import (
 	"errors"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/freikugel0/boorumesh-be/internal/domain"
 	"github.com/freikugel0/boorumesh-be/internal/service"
 	"github.com/gin-gonic/gin"
 )
 
 type ApiHandler struct {
 	fetchService service.SourceFetchService
+	adminToken   string
 }
 
-func NewApiHandler(fetchService service.SourceFetchService) *ApiHandler {
-	return &ApiHandler{fetchService: fetchService}
+// NewApiHandler builds the public API handler. Requests carrying adminToken
+// in X-Admin-Token get extra details such as upstream URLs; an empty token
+// disables that.
+func NewApiHandler(fetchService service.SourceFetchService, adminToken string) *ApiHandler {
+	return &ApiHandler{fetchService: fetchService, adminToken: adminToken}
 }
 
 func (h *ApiHandler) GetImagesBySource(c *gin.Context) {
@@ -27,47 +34,193 @@ func (h *ApiHandler) GetImagesBySource(c *gin.Context) {
 		return
 	}
 
+	started := time.Now()
+	envelope, err := envelopeVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	in := parseFetchParams(c)
+
+	ctx := c.Request.Context()
+
+	res, err := h.fetchService.FetchBySource(ctx, code, in)
+	if err != nil {
+		writeFetchError(c, err)
+		return
+	}
+
+	if res.Total != nil {
+		c.Header("X-Total-Count", strconv.Itoa(*res.Total))
+	}
+	if res.Cached {
+		c.Header("X-Cache", "HIT")
+	} else {
+		c.Header("X-Cache", "MISS")
+	}
+	if res.NextCursor != "" {
+		c.Header("X-Next-Cursor", res.NextCursor)
+	}
+	if res.PrevCursor != "" {
+		c.Header("X-Prev-Cursor", res.PrevCursor)
+	}
+
+	debug := c.Query("debug") == "1"
+	if envelope == envelopeV1 {
+		env := newPageEnvelopeV1(c, in, res, started, isAdmin(c, h.adminToken))
+		if debug {
+			env.Debug = gin.H{"mapping": res.Mapping, "query": res.Query}
+		}
+		c.JSON(http.StatusOK, env)
+		return
+	}
+
+	// Debug envelope: same images plus why any posts were dropped.
+	if debug {
+		c.JSON(http.StatusOK, gin.H{
+			"items": res.Images,
+			"debug": gin.H{"mapping": res.Mapping, "query": res.Query},
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, res.Images)
+}
+
+// GetPost returns a single upstream post by its upstream ID.
+func (h *ApiHandler) GetPost(c *gin.Context) {
+	code := strings.TrimSpace(c.Param("source"))
+	id := strings.TrimSpace(c.Param("id"))
+	if code == "" || id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "source and id are required",
+		})
+		return
+	}
+
+	res, err := h.fetchService.FetchPost(c.Request.Context(), code, id)
+	if err != nil {
+		writeFetchError(c, err)
+		return
+	}
+
+	if res.Cached {
+		c.Header("X-Cache", "HIT")
+	} else {
+		c.Header("X-Cache", "MISS")
+	}
+	c.JSON(http.StatusOK, res.Image)
+}
+
+func (h *ApiHandler) Search(c *gin.Context) {
+	in := parseFetchParams(c)
+	// prefer=danbooru,gelbooru decides which copy of a duplicate is kept
+	for _, code := range strings.Split(c.Query("prefer"), ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			in.Prefer = append(in.Prefer, domain.SourceCode(code))
+		}
+	}
+	in.KeepDuplicates = c.Query("dedupe") == "0"
+
+	ctx := c.Request.Context()
+
+	result, err := h.fetchService.Search(ctx, in)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidQuery) || errors.Is(err, service.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":  "failed to search sources",
+			"detail": service.ErrorText(err),
+		})
+		return
+	}
+
+	if c.Query("debug") != "1" {
+		for i := range result.Sources {
+			result.Sources[i].Mapping = nil
+			result.Sources[i].Query = nil
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// writeFetchError maps errors from the single-source fetch paths to responses.
+func writeFetchError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrSourceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
+	case errors.Is(err, service.ErrPostNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "post not found"})
+	case errors.Is(err, service.ErrSourceDisabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source is disabled"})
+	case errors.Is(err, service.ErrSourceAuthUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrInvalidQuery),
+		errors.Is(err, service.ErrUnsupportedQuery),
+		errors.Is(err, service.ErrInvalidCursor),
+		errors.Is(err, service.ErrPostLookupUnsupported):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrRateLimited):
+		var rl *service.RateLimitedError
+		if errors.As(err, &rl) {
+			c.Header("Retry-After", retryAfterSeconds(rl.RetryAfter))
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "source rate limit exceeded"})
+	case errors.Is(err, service.ErrCircuitOpen):
+		var co *service.CircuitOpenError
+		if errors.As(err, &co) {
+			c.Header("Retry-After", retryAfterSeconds(co.RetryAfter))
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":  "source temporarily unavailable",
+			"detail": service.ErrorText(err),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":  "failed to fetch from source",
+			"detail": service.ErrorText(err),
+		})
+	}
+}
+
+// retryAfterSeconds formats a delay for the Retry-After header, rounding up
+// so clients never retry too early.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// parseFetchParams reads the tags/page/limit/raw/cursor query params shared
+// by the fetch endpoints.
+func parseFetchParams(c *gin.Context) service.FetchInput {
+	var in service.FetchInput
+
 	// tags=tag1 tag2 tag3 (space separated)
 	tagsRaw := strings.TrimSpace(c.Query("tags"))
-	var tags []string
 	if tagsRaw != "" {
-		tags = strings.Fields(tagsRaw)
+		in.Tags = strings.Fields(tagsRaw)
 	}
 
-	page := 1
+	in.Page = 1
 	if pStr := c.Query("page"); pStr != "" {
 		if p, err := strconv.Atoi(pStr); err == nil && p > 0 {
-			page = p
+			in.Page = p
 		}
 	}
 
-	limit := 0
 	if lStr := c.Query("limit"); lStr != "" {
 		if l, err := strconv.Atoi(lStr); err == nil && l > 0 {
-			limit = l
+			in.Limit = l
 		}
 	}
 
 	// Option for disabling tags suffix
-	raw := c.Query("raw") == "1"
-
-	ctx := c.Request.Context()
+	in.Raw = c.Query("raw") == "1"
 
-	images, err := h.fetchService.FetchBySource(ctx, code, tags, page, limit, raw)
-	if err != nil {
-		switch {
-		case errors.Is(err, service.ErrSourceNotFound):
-			c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
-		case errors.Is(err, service.ErrSourceDisabled):
-			c.JSON(http.StatusBadRequest, gin.H{"error": "source is disabled"})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":  "failed to fetch from source",
-				"detail": err.Error(),
-			})
-		}
-		return
-	}
+	in.Cursor = strings.TrimSpace(c.Query("cursor"))
 
-	c.JSON(http.StatusOK, images)
+	return in
 }
@@ -1,12 +1,16 @@
 package handler
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/freikugel0/boorumesh-be/internal/domain"
 	"github.com/freikugel0/boorumesh-be/internal/repository"
 	"github.com/freikugel0/boorumesh-be/internal/service"
 )
@@ -33,15 +37,19 @@ func (h *DevSourceHandler) Create(c *gin.Context) {
 	if err != nil {
 		status := http.StatusInternalServerError
 
-		switch err {
-		case repository.ErrSourceExists:
+		switch {
+		case errors.Is(err, repository.ErrSourceExists),
+			errors.Is(err, repository.ErrSourceDeleted):
 			status = http.StatusConflict
+		case errors.Is(err, service.ErrInvalidSource):
+			status = http.StatusBadRequest
 		}
 		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusCreated, out)
+	c.Header("ETag", sourceETag(out))
+	c.JSON(http.StatusCreated, out.Redacted())
 }
 
 func (h *DevSourceHandler) GetSourceByCode(c *gin.Context) {
@@ -70,5 +78,227 @@ func (h *DevSourceHandler) GetSourceByCode(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, src)
+	c.Header("ETag", sourceETag(src))
+	c.JSON(http.StatusOK, src.Redacted())
+}
+
+// Update applies a JSON merge patch to a source. The caller may pin the
+// version it edited either with an If-Match ETag or an "updated_at" field
+// in the patch body.
+func (h *DevSourceHandler) Update(c *gin.Context) {
+	code := strings.TrimSpace(c.Param("code"))
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "code is required",
+		})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "invalid payload",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "invalid payload",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	var in service.UpdateSourceInput
+
+	if ifMatch := strings.TrimSpace(c.GetHeader("If-Match")); ifMatch != "" && ifMatch != "*" {
+		ts, ok := parseSourceETag(ifMatch)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid If-Match header"})
+			return
+		}
+		in.ExpectedUpdatedAt = &ts
+	}
+	if rawTS, ok := patch["updated_at"]; ok {
+		var ts time.Time
+		if err := json.Unmarshal(rawTS, &ts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid updated_at"})
+			return
+		}
+		if in.ExpectedUpdatedAt == nil {
+			in.ExpectedUpdatedAt = &ts
+		}
+		delete(patch, "updated_at")
+	}
+
+	in.Patch, err = json.Marshal(patch)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	out, err := h.svc.UpdateSource(c.Request.Context(), code, in)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrSourceNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
+		case errors.Is(err, service.ErrSourceConflict):
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrInvalidSource):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		}
+		return
+	}
+
+	c.Header("ETag", sourceETag(out))
+	c.JSON(http.StatusOK, out.Redacted())
+}
+
+// List returns sources filtered by ?enabled=, ?code_prefix= and ?q= (name
+// search), paginated with ?cursor= and ?limit=. ?deleted=1 lists the
+// soft-deleted sources that can still be restored.
+func (h *DevSourceHandler) List(c *gin.Context) {
+	in := service.ListSourcesInput{
+		CodePrefix: c.Query("code_prefix"),
+		Query:      c.Query("q"),
+		Deleted:    c.Query("deleted") == "1",
+		Cursor:     c.Query("cursor"),
+	}
+
+	if eStr := c.Query("enabled"); eStr != "" {
+		enabled, err := strconv.ParseBool(eStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "enabled must be a boolean"})
+			return
+		}
+		in.Enabled = &enabled
+	}
+	if lStr := c.Query("limit"); lStr != "" {
+		if l, err := strconv.Atoi(lStr); err == nil && l > 0 {
+			in.Limit = l
+		}
+	}
+
+	out, err := h.svc.ListSources(c.Request.Context(), in)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidSource):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		}
+		return
+	}
+
+	for i := range out.Items {
+		out.Items[i] = out.Items[i].Redacted()
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func (h *DevSourceHandler) Delete(c *gin.Context) {
+	code := strings.TrimSpace(c.Param("code"))
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "code is required",
+		})
+		return
+	}
+
+	if err := h.svc.DeleteSource(c.Request.Context(), code); err != nil {
+		switch {
+		case errors.Is(err, service.ErrSourceNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *DevSourceHandler) Restore(c *gin.Context) {
+	code := strings.TrimSpace(c.Param("code"))
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "code is required",
+		})
+		return
+	}
+
+	src, err := h.svc.RestoreSource(c.Request.Context(), code)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrSourceNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "deleted source not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		}
+		return
+	}
+
+	c.Header("ETag", sourceETag(src))
+	c.JSON(http.StatusOK, src.Redacted())
+}
+
+// Test dry-runs a source config without saving it. It returns the upstream
+// URL that was built, the raw records, the mapped images and a per-field
+// resolution report.
+func (h *DevSourceHandler) Test(c *gin.Context) {
+	var in service.TestSourceInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "invalid payload",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	out, err := h.svc.TestSource(c.Request.Context(), in)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrInvalidSource),
+			errors.Is(err, service.ErrInvalidQuery),
+			errors.Is(err, service.ErrUnsupportedQuery):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// MappingStats reports cumulative per-source mapping counters, so sources
+// whose upstream schema drifted (many dropped posts) stand out.
+func (h *DevSourceHandler) MappingStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"sources": h.svc.MappingStats(c.Request.Context())})
+}
+
+// BreakerStates shows the circuit breaker of every source that has made an
+// upstream call since the process started.
+func (h *DevSourceHandler) BreakerStates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"breakers": h.svc.BreakerStates(c.Request.Context())})
+}
+
+// sourceETag derives a strong ETag from the source's updated_at.
+func sourceETag(src domain.Source) string {
+	return `"` + strconv.FormatInt(src.UpdatedAt.UnixMicro(), 10) + `"`
+}
+
+func parseSourceETag(tag string) (time.Time, bool) {
+	tag = strings.TrimPrefix(tag, "W/")
+	tag = strings.Trim(tag, `"`)
+	us, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMicro(us), true
 }
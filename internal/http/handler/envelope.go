@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+	"github.com/freikugel0/boorumesh-be/internal/service"
+)
+
+const (
+	envelopeV1 = "v1"
+	// mediaTypeV1 selects the v1 envelope through the Accept header.
+	mediaTypeV1 = "application/vnd.boorumesh.v1+json"
+)
+
+var errUnsupportedEnvelope = errors.New("unsupported envelope version, use envelope=v1")
+
+// pageEnvelopeV1 is the opt-in response of GET /api/:source. Clients that
+// don't ask for it keep getting the bare image array.
+type pageEnvelopeV1 struct {
+	Version        string         `json:"version"`
+	Items          []domain.Image `json:"items"`
+	Page           int            `json:"page"`
+	LimitRequested *int           `json:"limit_requested"`
+	LimitApplied   int            `json:"limit_applied"`
+	HasMore        bool           `json:"has_more"`
+	Total          *int           `json:"total,omitempty"`
+	NextCursor     string         `json:"next_cursor,omitempty"`
+	PrevCursor     string         `json:"prev_cursor,omitempty"`
+	Links          envelopeLinks  `json:"links"`
+	Cached         bool           `json:"cached"`
+	TookMS         int64          `json:"took_ms"`
+	// UpstreamURL is only shown to admins.
+	UpstreamURL string `json:"upstream_url,omitempty"`
+	Debug       gin.H  `json:"debug,omitempty"`
+}
+
+type envelopeLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// envelopeVersion returns the envelope the client asked for, "" for the
+// bare array.
+func envelopeVersion(c *gin.Context) (string, error) {
+	if v, ok := c.GetQuery("envelope"); ok {
+		if v != envelopeV1 {
+			return "", errUnsupportedEnvelope
+		}
+		return envelopeV1, nil
+	}
+	if strings.Contains(c.GetHeader("Accept"), mediaTypeV1) {
+		return envelopeV1, nil
+	}
+	return "", nil
+}
+
+func newPageEnvelopeV1(c *gin.Context, in service.FetchInput, res service.FetchResult, started time.Time, admin bool) pageEnvelopeV1 {
+	env := pageEnvelopeV1{
+		Version:      envelopeV1,
+		Items:        res.Images,
+		Page:         res.Page,
+		LimitApplied: res.Limit,
+		HasMore:      res.NextCursor != "",
+		Total:        res.Total,
+		NextCursor:   res.NextCursor,
+		PrevCursor:   res.PrevCursor,
+		Links: envelopeLinks{
+			Next: cursorLink(c, res.NextCursor),
+			Prev: cursorLink(c, res.PrevCursor),
+		},
+		Cached: res.Cached,
+		TookMS: time.Since(started).Milliseconds(),
+	}
+	if in.Limit > 0 {
+		limit := in.Limit
+		env.LimitRequested = &limit
+	}
+	if admin {
+		env.UpstreamURL = res.URL
+	}
+	return env
+}
+
+// cursorLink is the current request with page replaced by cursor.
+func cursorLink(c *gin.Context, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	q := c.Request.URL.Query()
+	q.Del("page")
+	q.Set("cursor", cursor)
+	u := url.URL{Path: c.Request.URL.Path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// isAdmin reports whether the request carries the configured admin token.
+// Without a configured token nobody is an admin.
+func isAdmin(c *gin.Context, token string) bool {
+	if token == "" {
+		return false
+	}
+	got := c.GetHeader("X-Admin-Token")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
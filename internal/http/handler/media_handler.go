@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/freikugel0/boorumesh-be/internal/media"
+	"github.com/freikugel0/boorumesh-be/internal/service"
+)
+
+type MediaHandler struct {
+	svc    service.MediaService
+	signer *media.Signer
+}
+
+func NewMediaHandler(svc service.MediaService, signer *media.Signer) *MediaHandler {
+	return &MediaHandler{svc: svc, signer: signer}
+}
+
+// Proxy streams an upstream media file:
+// GET /media/:source/<expires>/<sig>/<key>/<scheme>/<host>/<path>.
+func (h *MediaHandler) Proxy(c *gin.Context) {
+	// Work on the escaped path so upstream file names reach the CDN exactly
+	// as they were written, and match what was signed.
+	req, err := media.ParseProxyPath(c.Request.URL.EscapedPath(), c.Request.URL.RawQuery)
+	if err == nil {
+		err = req.Verify(h.signer, time.Now())
+	}
+	switch {
+	case errors.Is(err, media.ErrUnsigned),
+		errors.Is(err, media.ErrBadSig),
+		errors.Is(err, media.ErrExpired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid media url"})
+		return
+	}
+
+	stream, err := h.svc.Open(c.Request.Context(), req, c.Request.Header)
+	if err != nil {
+		writeMediaError(c, err)
+		return
+	}
+	serveMedia(c, stream, req)
+}
+
+// Thumb serves a resized image:
+// GET /media/thumb/:source?url=...&w=...&key=...&exp=...&sig=...
+func (h *MediaHandler) Thumb(c *gin.Context) {
+	req, err := media.ParseThumbQuery(c.Param("source"), c.Request.URL.Query())
+	if err == nil {
+		err = req.Verify(h.signer, time.Now())
+	}
+	switch {
+	case errors.Is(err, media.ErrUnsigned),
+		errors.Is(err, media.ErrBadSig),
+		errors.Is(err, media.ErrExpired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, media.ErrBadWidth):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "allowed": media.ThumbWidths})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid media url"})
+		return
+	}
+
+	stream, err := h.svc.Thumbnail(c.Request.Context(), req)
+	if err != nil {
+		writeMediaError(c, err)
+		return
+	}
+	serveMedia(c, stream, req.ProxyRequest)
+}
+
+func serveMedia(c *gin.Context, stream *service.MediaStream, req media.ProxyRequest) {
+	defer stream.Body.Close()
+
+	// Upstream bytes are served from our origin; never let browsers guess
+	// a more dangerous type than the one checked.
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	if f := stream.Cached; f != nil {
+		// ServeContent answers ranges and conditional requests from disk,
+		// using the stored ETag and Last-Modified.
+		for k, v := range stream.Header {
+			c.Writer.Header()[k] = v
+		}
+		c.Header("X-Media-Cache", "hit")
+		http.ServeContent(c.Writer, c.Request, "", f.ModTime, f)
+		return
+	}
+
+	for k, v := range stream.Header {
+		c.Writer.Header()[k] = v
+	}
+	c.Status(stream.StatusCode)
+	if _, err := io.Copy(c.Writer, stream.Body); err != nil && c.Request.Context().Err() == nil {
+		log.Printf("media %s %s: %v", req.Code, req.Target.Host, err)
+	}
+}
+
+func writeMediaError(c *gin.Context, err error) {
+	var statusErr *service.UpstreamStatusError
+	switch {
+	case errors.Is(err, service.ErrSourceNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "source not found"})
+	case errors.Is(err, service.ErrSourceDisabled),
+		errors.Is(err, service.ErrMediaDisabled),
+		errors.Is(err, service.ErrMediaHostNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrMediaTooLarge),
+		errors.Is(err, media.ErrImageTooLarge):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrMediaType):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	case errors.Is(err, media.ErrNotAnImage):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusNotFound, http.StatusGone:
+			c.JSON(http.StatusNotFound, gin.H{"error": "media not found upstream"})
+		case http.StatusRequestedRangeNotSatisfiable:
+			c.Status(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch media", "detail": err.Error()})
+		}
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to fetch media", "detail": err.Error()})
+	}
+}
+
+// CacheUsage reports the media disk cache usage per source.
+func (h *MediaHandler) CacheUsage(c *gin.Context) {
+	usage, err := h.svc.CacheUsage()
+	if err != nil {
+		writeMediaCacheError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// PurgeCache empties the media disk cache, for one source with ?source=.
+func (h *MediaHandler) PurgeCache(c *gin.Context) {
+	freed, err := h.svc.PurgeCache(c.Query("source"))
+	if err != nil {
+		writeMediaCacheError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": freed})
+}
+
+func writeMediaCacheError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrMediaCacheDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -6,20 +6,37 @@ import (
 	"github.com/freikugel0/boorumesh-be/internal/http/handler"
 )
 
-func NewRouter(devSrcHandler *handler.DevSourceHandler, apiHandler *handler.ApiHandler) *gin.Engine {
+func NewRouter(devSrcHandler *handler.DevSourceHandler, apiHandler *handler.ApiHandler, mediaHandler *handler.MediaHandler) *gin.Engine {
 	r := gin.Default()
 
 	r.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"status": "ok"}) })
 
 	dev := r.Group("/dev")
 	{
+		dev.GET("/sources", devSrcHandler.List)
 		dev.POST("/sources", devSrcHandler.Create)
+		dev.POST("/sources/test", devSrcHandler.Test)
 		dev.GET("/sources/:code", devSrcHandler.GetSourceByCode)
+		dev.PATCH("/sources/:code", devSrcHandler.Update)
+		dev.DELETE("/sources/:code", devSrcHandler.Delete)
+		dev.POST("/sources/:code/restore", devSrcHandler.Restore)
+		dev.GET("/stats/mapping", devSrcHandler.MappingStats)
+		dev.GET("/stats/breakers", devSrcHandler.BreakerStates)
 	}
 
 	api := r.Group("/api")
 	{
+		api.GET("/search", apiHandler.Search)
 		api.GET("/:source", apiHandler.GetImagesBySource)
+		api.GET("/:source/posts/:id", apiHandler.GetPost)
+	}
+
+	// The media proxy is only mounted when a signing key is configured.
+	if mediaHandler != nil {
+		r.GET("/media/thumb/:source", mediaHandler.Thumb)
+		r.GET("/media/:source/*target", mediaHandler.Proxy)
+		dev.GET("/media/cache", mediaHandler.CacheUsage)
+		dev.DELETE("/media/cache", mediaHandler.PurgeCache)
 	}
 
 	return r
@@ -0,0 +1,448 @@
+package media
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheMagic  = "BMC1"
+	tempSuffix  = ".tmp"
+	maxMetaSize = 4 << 10
+)
+
+var errBadCacheFile = errors.New("invalid cache file")
+
+// DiskCache stores proxied media files under dir/<source>/<shard>/<key>,
+// evicting the least recently used files once the total size exceeds the
+// budget. Files are written to a temp file and renamed into place when
+// complete, so readers never see a partial file.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List               // front = most recently used
+	entries map[string]*list.Element // relative path → element
+	total   int64
+}
+
+type diskEntry struct {
+	source string
+	path   string // relative to dir
+	size   int64
+}
+
+// CacheMeta is stored in front of the body of every cached file: what to
+// serve it as, and the upstream's validators.
+type CacheMeta struct {
+	ContentType  string `json:"content_type"`
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	CacheControl string `json:"cache_control,omitempty"`
+}
+
+// NewDiskCache opens (creating it if needed) a cache in dir. Cache files
+// left by a previous run are indexed, oldest first by the time they were
+// written, and the temp files it left behind are removed. Anything else in
+// dir is left alone, so a misconfigured directory never loses unrelated
+// files.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	type found struct {
+		entry diskEntry
+		mtime time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if d.IsDir() {
+			// Only descend into <source>/<shard>.
+			if rel != "." && len(parts) > 2 {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if len(parts) != 3 {
+			return nil
+		}
+		source, name := parts[0], parts[2]
+
+		if key, ok := tempFileKey(name); ok {
+			if want, valid := c.relPath(source, key); valid && filepath.Dir(want) == filepath.Dir(rel) {
+				return os.Remove(path)
+			}
+			return nil
+		}
+		if want, ok := c.relPath(source, name); !ok || want != rel {
+			return nil
+		}
+		if !hasCacheMagic(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, found{diskEntry{source: source, path: rel, size: info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		c.add(f.entry)
+	}
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// CachedFile is a cache hit. It reads the body only, and must be closed.
+// ModTime is the upstream Last-Modified, or when the file was cached.
+type CachedFile struct {
+	*io.SectionReader
+	CacheMeta
+	ModTime time.Time
+	f       *os.File
+}
+
+func (f *CachedFile) Close() error {
+	return f.f.Close()
+}
+
+// Open returns the cached file for source and key, if there is one.
+func (c *DiskCache) Open(source, key string) (*CachedFile, bool) {
+	rel, ok := c.relPath(source, key)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	el, ok := c.entries[rel]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, rel)
+	f, err := os.Open(path)
+	if err != nil {
+		c.remove(rel)
+		return nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false
+	}
+	meta, offset, err := readCacheHeader(f)
+	if err != nil {
+		f.Close()
+		c.remove(rel)
+		os.Remove(path)
+		return nil, false
+	}
+
+	// Recency is tracked in memory only; the file's mtime stays the time it
+	// was cached, so it can serve as a stable Last-Modified.
+	modTime := info.ModTime()
+	if t, err := http.ParseTime(meta.LastModified); err == nil {
+		modTime = t
+	}
+
+	return &CachedFile{
+		SectionReader: io.NewSectionReader(f, offset, info.Size()-offset),
+		CacheMeta:     meta,
+		ModTime:       modTime,
+		f:             f,
+	}, true
+}
+
+// CacheWriter receives a file being added to the cache. Nothing becomes
+// visible until Commit; Abort throws the partial file away.
+type CacheWriter struct {
+	c      *DiskCache
+	source string
+	rel    string
+	tmp    *os.File
+	err    error
+}
+
+// Create starts writing the file for source and key.
+func (c *DiskCache) Create(source, key string, meta CacheMeta) (*CacheWriter, error) {
+	rel, ok := c.relPath(source, key)
+	if !ok {
+		return nil, errBadCacheFile
+	}
+	path := filepath.Join(c.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &CacheWriter{c: c, source: source, rel: rel, tmp: tmp}
+	if err := writeCacheHeader(tmp, meta); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *CacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.tmp.Write(p)
+	w.err = err
+	return n, err
+}
+
+// Commit moves the finished file into place.
+func (w *CacheWriter) Commit() error {
+	if w.err != nil {
+		w.Abort()
+		return w.err
+	}
+	info, err := w.tmp.Stat()
+	if err == nil {
+		err = w.tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(w.tmp.Name(), filepath.Join(w.c.dir, w.rel))
+	}
+	if err != nil {
+		os.Remove(w.tmp.Name())
+		return err
+	}
+	w.c.add(diskEntry{source: w.source, path: w.rel, size: info.Size()})
+	w.c.mu.Lock()
+	w.c.evictLocked()
+	w.c.mu.Unlock()
+	return nil
+}
+
+// Abort discards the partial file.
+func (w *CacheWriter) Abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// SourceUsage is the cache usage of one source.
+type SourceUsage struct {
+	Source string `json:"source"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// CacheUsage summarizes what the cache holds.
+type CacheUsage struct {
+	Dir        string        `json:"dir"`
+	MaxBytes   int64         `json:"max_bytes"`
+	TotalBytes int64         `json:"total_bytes"`
+	Files      int           `json:"files"`
+	Sources    []SourceUsage `json:"sources"`
+}
+
+func (c *DiskCache) Usage() CacheUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bySource := map[string]*SourceUsage{}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(diskEntry)
+		u, ok := bySource[e.source]
+		if !ok {
+			u = &SourceUsage{Source: e.source}
+			bySource[e.source] = u
+		}
+		u.Files++
+		u.Bytes += e.size
+	}
+
+	out := CacheUsage{
+		Dir:        c.dir,
+		MaxBytes:   c.maxBytes,
+		TotalBytes: c.total,
+		Files:      c.lru.Len(),
+		Sources:    make([]SourceUsage, 0, len(bySource)),
+	}
+	for _, u := range bySource {
+		out.Sources = append(out.Sources, *u)
+	}
+	sort.Slice(out.Sources, func(i, j int) bool { return out.Sources[i].Source < out.Sources[j].Source })
+	return out
+}
+
+// Purge removes every file cached for source, or the whole cache when
+// source is empty, and reports what was freed.
+func (c *DiskCache) Purge(source string) (SourceUsage, error) {
+	freed := SourceUsage{Source: source}
+	var paths []string
+
+	c.mu.Lock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(diskEntry)
+		if source == "" || e.source == source {
+			c.removeLocked(el)
+			paths = append(paths, e.path)
+			freed.Files++
+			freed.Bytes += e.size
+		}
+		el = next
+	}
+	c.mu.Unlock()
+
+	var firstErr error
+	for _, rel := range paths {
+		if err := os.Remove(filepath.Join(c.dir, rel)); err != nil && !errors.Is(err, fs.ErrNotExist) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return freed, firstErr
+}
+
+// tempFileKey returns the key of a temp file named by Create
+// (<key>.<random digits>.tmp).
+func tempFileKey(name string) (string, bool) {
+	rest, ok := strings.CutSuffix(name, tempSuffix)
+	if !ok {
+		return "", false
+	}
+	key, random, ok := strings.Cut(rest, ".")
+	if !ok || random == "" || strings.Trim(random, "0123456789") != "" || !validKey(key) {
+		return "", false
+	}
+	return key, true
+}
+
+// hasCacheMagic reports whether the file at path starts like a cache file.
+func hasCacheMagic(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(cacheMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == cacheMagic
+}
+
+// relPath maps source and key to a path inside the cache, refusing
+// anything that could escape it.
+func (c *DiskCache) relPath(source, key string) (string, bool) {
+	if !validKey(key) || source == "" || source == "." || source == ".." ||
+		strings.ContainsAny(source, `/\`) {
+		return "", false
+	}
+	return filepath.Join(source, key[:2], key), true
+}
+
+func (c *DiskCache) add(e diskEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.path]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[e.path] = c.lru.PushFront(e)
+	c.total += e.size
+}
+
+func (c *DiskCache) remove(rel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[rel]; ok {
+		c.removeLocked(el)
+	}
+}
+
+func (c *DiskCache) removeLocked(el *list.Element) {
+	e := c.lru.Remove(el).(diskEntry)
+	delete(c.entries, e.path)
+	c.total -= e.size
+}
+
+// evictLocked deletes least recently used files until the cache fits its
+// budget. Open readers keep working on evicted files until they close them.
+func (c *DiskCache) evictLocked() {
+	for c.total > c.maxBytes && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		e := el.Value.(diskEntry)
+		c.removeLocked(el)
+		os.Remove(filepath.Join(c.dir, e.path))
+	}
+}
+
+func writeCacheHeader(w io.Writer, meta CacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, len(cacheMagic)+4, len(cacheMagic)+4+len(data))
+	copy(hdr, cacheMagic)
+	binary.BigEndian.PutUint32(hdr[len(cacheMagic):], uint32(len(data)))
+	_, err = w.Write(append(hdr, data...))
+	return err
+}
+
+// readCacheHeader returns the file's metadata and where its body starts.
+func readCacheHeader(r io.Reader) (CacheMeta, int64, error) {
+	var meta CacheMeta
+	hdr := make([]byte, len(cacheMagic)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil || string(hdr[:len(cacheMagic)]) != cacheMagic {
+		return meta, 0, errBadCacheFile
+	}
+	n := binary.BigEndian.Uint32(hdr[len(cacheMagic):])
+	if n > maxMetaSize {
+		return meta, 0, errBadCacheFile
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return meta, 0, errBadCacheFile
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, 0, errBadCacheFile
+	}
+	return meta, int64(len(hdr)) + int64(n), nil
+}
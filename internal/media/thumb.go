@@ -0,0 +1,83 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"slices"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ThumbWidths are the widths thumbnails can be requested in. Keeping the
+// set small keeps the cache small and stops clients from asking for
+// arbitrary sizes.
+var ThumbWidths = []int{150, 250, 360, 480, 720}
+
+// DefaultThumbWidth is used when no width is requested, and for previews
+// filled in for sources that don't map one.
+const DefaultThumbWidth = 250
+
+// maxThumbPixels bounds the images we are willing to decode: about 64 MB
+// as RGBA. Larger originals usually have a sample to thumbnail instead.
+const maxThumbPixels = 16_000_000
+
+var (
+	ErrBadWidth      = errors.New("unsupported thumbnail width")
+	ErrNotAnImage    = errors.New("media is not a supported image")
+	ErrImageTooLarge = errors.New("image is too large to thumbnail")
+)
+
+// ValidThumbWidth reports whether w is one of ThumbWidths.
+func ValidThumbWidth(w int) bool {
+	return slices.Contains(ThumbWidths, w)
+}
+
+// Thumbnail decodes a JPEG, PNG, GIF (first frame) or WebP image and scales
+// it down to width, keeping the aspect ratio. Images no wider than width are
+// only re-encoded. The result is a JPEG, or a PNG if the image has
+// transparency.
+func Thumbnail(r io.Reader, width int) ([]byte, string, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, "", ErrNotAnImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxThumbPixels {
+		return nil, "", ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, "", ErrNotAnImage
+	}
+
+	b := src.Bounds()
+	dst := src
+	if b.Dx() > width {
+		height := max(1, b.Dy()*width/b.Dx())
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, b, draw.Src, nil)
+		dst = scaled
+	}
+
+	var out bytes.Buffer
+	if opaque(dst) {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85})
+		return out.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&out, dst)
+	return out.Bytes(), "image/png", err
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,356 @@
+// Package media builds and parses the URLs served by the media proxy.
+//
+// A proxied file lives at
+// /media/<source>/<expires>/<sig>/<key>/<scheme>/<host>/<path>?<query>, e.g.
+// /media/danbooru/1767225600/Zm9v.../0cc1...-file/https/cdn.donmai.us/original/ab/cd/abcd.jpg.
+// key names the file in the disk cache ("-" when the image's MD5 is unknown).
+// The signature covers the source, the expiry and everything after it, so
+// the proxy only fetches URLs this service handed out.
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// PathPrefix is where the media proxy is mounted, and ThumbPrefix where
+// thumbnails are served from. ThumbPrefix takes the place of a source's
+// proxy URLs, so ReservedCode can't be used as a source code.
+const (
+	PathPrefix   = "/media/"
+	ReservedCode = "thumb"
+	ThumbPrefix  = PathPrefix + ReservedCode + "/"
+)
+
+var ErrBadTarget = errors.New("invalid media target")
+
+// URLBuilder turns upstream media URLs into signed proxy URLs.
+type URLBuilder struct {
+	// base is the public origin of this service, e.g. https://api.example.com.
+	// Empty produces root-relative URLs.
+	base   string
+	signer *Signer
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+func NewURLBuilder(publicBaseURL string, signer *Signer, ttl time.Duration) *URLBuilder {
+	return &URLBuilder{
+		base:   strings.TrimRight(publicBaseURL, "/"),
+		signer: signer,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// ProxyURL returns the signed proxy URL serving upstream for source code.
+// key is the cache key from ImageKey, or empty.
+func (b *URLBuilder) ProxyURL(code domain.SourceCode, upstream, key string) (string, error) {
+	u, err := parseUpstream(upstream)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		key = "-"
+	}
+
+	target := key + "/" + u.Scheme + "/" + u.Host + u.EscapedPath()
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+
+	expires := b.expires()
+	sig := b.signer.Sign(string(code), expires, target)
+
+	return b.base + PathPrefix + url.PathEscape(string(code)) + "/" +
+		strconv.FormatInt(expires, 10) + "/" + sig + "/" + target, nil
+}
+
+// ThumbURL returns the signed URL of a width-wide thumbnail of upstream:
+// /media/thumb/<source>?url=...&w=...&key=...&exp=...&sig=...
+// The width isn't signed; clients may pick any of ThumbWidths.
+func (b *URLBuilder) ThumbURL(code domain.SourceCode, upstream, key string, width int) (string, error) {
+	u, err := parseUpstream(upstream)
+	if err != nil {
+		return "", err
+	}
+	expires := b.expires()
+
+	q := url.Values{}
+	q.Set("url", u.String())
+	q.Set("w", strconv.Itoa(width))
+	if key != "" {
+		q.Set("key", key)
+	}
+	q.Set("exp", strconv.FormatInt(expires, 10))
+	q.Set("sig", b.signer.Sign(string(code), expires, thumbSigned(key, u.String())))
+	return b.base + ThumbPrefix + url.PathEscape(string(code)) + "?" + q.Encode(), nil
+}
+
+// expires returns the expiry for URLs built now. It is rounded up to the
+// hour so a given image keeps the same URL for a while and browsers can
+// cache it.
+func (b *URLBuilder) expires() int64 {
+	return b.now().Add(b.ttl).Truncate(time.Hour).Add(time.Hour).Unix()
+}
+
+// ProxyRequest is a parsed proxy URL.
+type ProxyRequest struct {
+	Code      string
+	Expires   int64
+	Signature string
+	// Key is the cache key carried in the URL, empty if there is none.
+	Key string
+	// SignedTarget is the part of the URL the signature covers.
+	SignedTarget string
+	Target       *url.URL
+}
+
+// Verify checks the request's signature and expiry.
+func (r ProxyRequest) Verify(signer *Signer, now time.Time) error {
+	return signer.Verify(r.Code, r.Expires, r.SignedTarget, r.Signature, now)
+}
+
+// ParseProxyPath reads a proxy URL back from its escaped path
+// (/media/<source>/<expires>/<sig>/<key>/<scheme>/<host>/<path>) and raw query.
+func ParseProxyPath(escapedPath, rawQuery string) (ProxyRequest, error) {
+	rest, ok := strings.CutPrefix(escapedPath, PathPrefix)
+	if !ok {
+		return ProxyRequest{}, ErrBadTarget
+	}
+	parts := strings.SplitN(rest, "/", 5)
+	if len(parts) < 5 {
+		return ProxyRequest{}, ErrUnsigned
+	}
+
+	code, err := url.PathUnescape(parts[0])
+	if err != nil || code == "" {
+		return ProxyRequest{}, ErrBadTarget
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ProxyRequest{}, ErrUnsigned
+	}
+	key := parts[3]
+	if key == "-" {
+		key = ""
+	} else if !validKey(key) {
+		return ProxyRequest{}, ErrBadTarget
+	}
+	target, err := parseTarget(parts[4], rawQuery)
+	if err != nil {
+		return ProxyRequest{}, err
+	}
+
+	signed := parts[3] + "/" + parts[4]
+	if rawQuery != "" {
+		signed += "?" + rawQuery
+	}
+	return ProxyRequest{
+		Code:         code,
+		Expires:      expires,
+		Signature:    parts[2],
+		Key:          key,
+		SignedTarget: signed,
+		Target:       target,
+	}, nil
+}
+
+// ThumbRequest is a parsed thumbnail URL.
+type ThumbRequest struct {
+	ProxyRequest
+	Width int
+}
+
+// ParseThumbQuery reads a thumbnail request for source code from its query.
+func ParseThumbQuery(code string, q url.Values) (ThumbRequest, error) {
+	width := DefaultThumbWidth
+	if raw := q.Get("w"); raw != "" {
+		w, err := strconv.Atoi(raw)
+		if err != nil || !ValidThumbWidth(w) {
+			return ThumbRequest{}, ErrBadWidth
+		}
+		width = w
+	}
+
+	key := q.Get("key")
+	if key != "" && !validKey(key) {
+		return ThumbRequest{}, ErrBadTarget
+	}
+	target, err := parseUpstream(q.Get("url"))
+	if err != nil {
+		return ThumbRequest{}, err
+	}
+	expires, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return ThumbRequest{}, ErrUnsigned
+	}
+
+	return ThumbRequest{
+		ProxyRequest: ProxyRequest{
+			Code:         code,
+			Expires:      expires,
+			Signature:    q.Get("sig"),
+			Key:          key,
+			SignedTarget: thumbSigned(key, target.String()),
+			Target:       target,
+		},
+		Width: width,
+	}, nil
+}
+
+// thumbSigned is what a thumbnail URL's signature covers. The prefix keeps
+// it from ever matching a proxy path.
+func thumbSigned(key, upstream string) string {
+	return "thumb:" + key + ":" + upstream
+}
+
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, ErrBadTarget
+	}
+	return u, nil
+}
+
+// parseTarget reads the upstream URL back from <scheme>/<host>/<path> and
+// its raw query.
+func parseTarget(escapedTarget, rawQuery string) (*url.URL, error) {
+	scheme, rest, ok := strings.Cut(escapedTarget, "/")
+	if !ok || (scheme != "http" && scheme != "https") {
+		return nil, ErrBadTarget
+	}
+	host, path, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return nil, ErrBadTarget
+	}
+
+	u, err := url.Parse(scheme + "://" + host + "/" + path)
+	if err != nil || u.Host != host || u.User != nil {
+		return nil, ErrBadTarget
+	}
+	u.RawQuery = rawQuery
+	return u, nil
+}
+
+// HostAllowed reports whether host matches one of the patterns. A pattern
+// is an exact host name or "*.example.com", which matches example.com and
+// any of its subdomains.
+func HostAllowed(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite points an image's media URLs at the proxy. URLs that can't be
+// proxied, and those on hosts the source doesn't allow, are left as they are.
+// Images without a preview get a thumbnail of their sample or file.
+func (b *URLBuilder) Rewrite(src domain.Source, img *domain.Image) {
+	preview := ""
+	if img.PreviewURL == "" {
+		preview = b.fallbackPreview(src, img)
+	}
+
+	fields := []struct {
+		variant string
+		url     *string
+	}{
+		{"file", &img.FileURL},
+		{"sample", &img.SampleURL},
+		{"preview", &img.PreviewURL},
+	}
+	for _, f := range fields {
+		if *f.url == "" {
+			continue
+		}
+		u, err := url.Parse(*f.url)
+		if err != nil || !HostAllowed(u.Hostname(), src.Request.MediaHosts) {
+			continue
+		}
+		if proxied, err := b.ProxyURL(src.Code, *f.url, ImageKey(img.MD5, f.variant)); err == nil {
+			*f.url = proxied
+		}
+	}
+
+	if preview != "" {
+		img.PreviewURL = preview
+	}
+}
+
+// fallbackPreview returns a thumbnail URL for the sample, or else the file,
+// when it is a still image on an allowed host.
+func (b *URLBuilder) fallbackPreview(src domain.Source, img *domain.Image) string {
+	for _, c := range []struct{ variant, url string }{
+		{"sample", img.SampleURL},
+		{"file", img.FileURL},
+	} {
+		u, err := url.Parse(c.url)
+		if c.url == "" || err != nil || !HostAllowed(u.Hostname(), src.Request.MediaHosts) || !thumbnailable(u.Path) {
+			continue
+		}
+		thumb, err := b.ThumbURL(src.Code, c.url, ImageKey(img.MD5, "thumb"), DefaultThumbWidth)
+		if err == nil {
+			return thumb
+		}
+	}
+	return ""
+}
+
+// thumbnailable guesses from the extension whether a file can be decoded
+// by Thumbnail.
+func thumbnailable(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// ImageKey is the cache key for one variant (file, sample, preview) of the
+// image with the given MD5, or empty if md5 isn't a valid hash.
+func ImageKey(md5, variant string) string {
+	md5 = strings.ToLower(strings.TrimSpace(md5))
+	if len(md5) != 32 || strings.Trim(md5, "0123456789abcdef") != "" {
+		return ""
+	}
+	return md5 + "-" + variant
+}
+
+// URLKey is the cache key for a file only known by its URL.
+func URLKey(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return hex.EncodeToString(sum[:])
+}
+
+// validKey reports whether key looks like one made by ImageKey or URLKey,
+// which also makes it safe to use as a file name.
+func validKey(key string) bool {
+	if len(key) < 3 || len(key) > 80 {
+		return false
+	}
+	for _, r := range key {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
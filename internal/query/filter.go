@@ -0,0 +1,143 @@
+package query
+
+import (
+	"math/rand/v2"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// Filter applies the plan's post clauses to mapped images. Images keep their
+// upstream order unless an order clause had to be applied here, in which
+// case only the page at hand is sorted.
+func (p Plan) Filter(images []domain.Image) []domain.Image {
+	if len(p.Post) == 0 {
+		return images
+	}
+
+	var (
+		conds []Clause
+		order *Order
+	)
+	for _, c := range p.Post {
+		if c.Kind == KindOrder {
+			o := c.Order
+			order = &o
+			continue
+		}
+		conds = append(conds, c)
+	}
+
+	out := images
+	if len(conds) > 0 {
+		out = make([]domain.Image, 0, len(images))
+		for _, img := range images {
+			if matchAll(conds, img) {
+				out = append(out, img)
+			}
+		}
+	}
+	if order != nil {
+		sortImages(out, *order)
+	}
+	return out
+}
+
+func matchAll(conds []Clause, img domain.Image) bool {
+	for _, c := range conds {
+		if !match(c, img) {
+			return false
+		}
+	}
+	return true
+}
+
+func match(c Clause, img domain.Image) bool {
+	switch c.Kind {
+	case KindTag:
+		return hasTag(img, c.Tags[0]) != c.Negated
+	case KindOr:
+		for _, t := range c.Tags {
+			if hasTag(img, t) {
+				return true
+			}
+		}
+		return false
+	case KindRating:
+		if img.Rating == "" {
+			// Unknown ratings can't be shown to satisfy either form.
+			return false
+		}
+		return slices.Contains(c.Ratings, img.Rating) != c.Negated
+	case KindScore:
+		return img.Score != nil && c.Score.Match(*img.Score)
+	}
+	return true
+}
+
+// hasTag matches case-insensitively; * in the pattern matches any run of
+// characters.
+func hasTag(img domain.Image, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	wildcard := strings.Contains(pattern, "*")
+	for _, t := range img.Tags {
+		t = strings.ToLower(t)
+		if t == pattern {
+			return true
+		}
+		if wildcard && globMatch(pattern, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	// path.Match treats / specially, which tags may contain.
+	const sep = "\x00"
+	ok, err := path.Match(strings.ReplaceAll(pattern, "/", sep), strings.ReplaceAll(s, "/", sep))
+	return err == nil && ok
+}
+
+func sortImages(images []domain.Image, o Order) {
+	switch o {
+	case OrderRandom:
+		rand.Shuffle(len(images), func(i, j int) { images[i], images[j] = images[j], images[i] })
+	case OrderScore, OrderScoreAsc:
+		sort.SliceStable(images, func(i, j int) bool {
+			a, b := scoreOf(images[i]), scoreOf(images[j])
+			if o == OrderScoreAsc {
+				return a < b
+			}
+			return a > b
+		})
+	case OrderID, OrderIDAsc:
+		sort.SliceStable(images, func(i, j int) bool {
+			if o == OrderIDAsc {
+				return idLess(images[i].ID, images[j].ID)
+			}
+			return idLess(images[j].ID, images[i].ID)
+		})
+	}
+}
+
+func scoreOf(img domain.Image) int {
+	if img.Score == nil {
+		return 0
+	}
+	return *img.Score
+}
+
+// idLess compares numerically when both IDs are numbers.
+func idLess(a, b string) bool {
+	na, errA := strconv.ParseInt(a, 10, 64)
+	nb, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a < b
+}
@@ -0,0 +1,299 @@
+// Package query parses BooruMesh's unified tag query language and
+// translates it into each source's own search syntax.
+//
+// A query is a whitespace-separated list of clauses, all of which must match:
+//
+//	touhou            posts tagged touhou
+//	-comic            posts not tagged comic
+//	cat|dog           posts tagged cat or dog
+//	rating:g,s        rating general or sensitive (-rating:e excludes)
+//	score:>10         score comparison: >, >=, <, <=, exact or a..b
+//	order:score       ordering: score, score_asc, id, id_asc, random
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+type Kind int
+
+const (
+	KindTag Kind = iota
+	KindOr
+	KindRating
+	KindScore
+	KindOrder
+)
+
+type Order string
+
+const (
+	OrderScore    Order = "score"
+	OrderScoreAsc Order = "score_asc"
+	OrderID       Order = "id"
+	OrderIDAsc    Order = "id_asc"
+	OrderRandom   Order = "random"
+)
+
+func (o Order) valid() bool {
+	switch o {
+	case OrderScore, OrderScoreAsc, OrderID, OrderIDAsc, OrderRandom:
+		return true
+	}
+	return false
+}
+
+// Comparison is a numeric condition such as >10 or 5..20.
+type Comparison struct {
+	// Op is one of =, >, >=, <, <= or .. (inclusive range Value..Max).
+	Op    string
+	Value int
+	Max   int
+}
+
+func (c Comparison) Match(n int) bool {
+	switch c.Op {
+	case ">":
+		return n > c.Value
+	case ">=":
+		return n >= c.Value
+	case "<":
+		return n < c.Value
+	case "<=":
+		return n <= c.Value
+	case "..":
+		return n >= c.Value && n <= c.Max
+	default:
+		return n == c.Value
+	}
+}
+
+func (c Comparison) String() string {
+	switch c.Op {
+	case "=":
+		return strconv.Itoa(c.Value)
+	case "..":
+		return fmt.Sprintf("%d..%d", c.Value, c.Max)
+	default:
+		return c.Op + strconv.Itoa(c.Value)
+	}
+}
+
+// Clause is a single node of a parsed query. Which fields are set depends
+// on Kind.
+type Clause struct {
+	Kind    Kind
+	Negated bool
+	// Tags holds the tag for KindTag and the alternatives for KindOr.
+	Tags    []string
+	Ratings []domain.Rating
+	Score   Comparison
+	Order   Order
+}
+
+// String writes the clause back in the unified syntax.
+func (c Clause) String() string {
+	var s string
+	switch c.Kind {
+	case KindOr:
+		s = strings.Join(c.Tags, "|")
+	case KindRating:
+		parts := make([]string, len(c.Ratings))
+		for i, r := range c.Ratings {
+			parts[i] = string(r)
+		}
+		s = "rating:" + strings.Join(parts, ",")
+	case KindScore:
+		s = "score:" + c.Score.String()
+	case KindOrder:
+		s = "order:" + string(c.Order)
+	default:
+		s = c.Tags[0]
+	}
+	if c.Negated {
+		return "-" + s
+	}
+	return s
+}
+
+// native reports whether c is a tag that looks like one of the source's own
+// metatags (user:foo, fav:bar). Only the source can evaluate those, so they
+// are never post-filtered.
+func (c Clause) native() bool {
+	return c.Kind == KindTag && strings.Index(c.Tags[0], ":") > 0
+}
+
+// Query is a parsed query. Raw keeps the tokens as they were given, for
+// sources that take the query verbatim.
+type Query struct {
+	Clauses []Clause
+	Raw     []string
+}
+
+// HasOrder reports whether q asks for a specific order.
+func (q Query) HasOrder() bool {
+	for _, c := range q.Clauses {
+		if c.Kind == KindOrder {
+			return true
+		}
+	}
+	return false
+}
+
+// SyntaxError reports a clause that could not be parsed.
+type SyntaxError struct {
+	Clause string
+	Reason string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid query clause %q: %s", e.Clause, e.Reason)
+}
+
+// Parse reads a query from whitespace-separated tokens.
+func Parse(tokens []string) (Query, error) {
+	q := Query{Raw: tokens}
+	hasOrder := false
+
+	for _, tok := range tokens {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+
+		c, err := parseClause(tok)
+		if err != nil {
+			return Query{}, err
+		}
+		if c.Kind == KindOrder {
+			if hasOrder {
+				return Query{}, &SyntaxError{Clause: tok, Reason: "only one order clause is allowed"}
+			}
+			hasOrder = true
+		}
+		q.Clauses = append(q.Clauses, c)
+	}
+
+	return q, nil
+}
+
+func parseClause(tok string) (Clause, error) {
+	body := tok
+	negated := false
+	if strings.HasPrefix(body, "-") && len(body) > 1 {
+		negated = true
+		body = body[1:]
+	}
+
+	if strings.Contains(body, "|") {
+		if negated {
+			return Clause{}, &SyntaxError{Clause: tok, Reason: "an OR group cannot be negated"}
+		}
+		alts := strings.Split(body, "|")
+		for _, alt := range alts {
+			if alt == "" || strings.HasPrefix(alt, "-") || isMeta(alt) {
+				return Clause{}, &SyntaxError{Clause: tok, Reason: "OR alternatives must be plain tags"}
+			}
+		}
+		return Clause{Kind: KindOr, Tags: alts}, nil
+	}
+
+	name, value, _ := strings.Cut(body, ":")
+	switch strings.ToLower(name) {
+	case "rating":
+		ratings, err := parseRatings(value)
+		if err != nil {
+			return Clause{}, &SyntaxError{Clause: tok, Reason: err.Error()}
+		}
+		return Clause{Kind: KindRating, Negated: negated, Ratings: ratings}, nil
+	case "score":
+		if negated {
+			return Clause{}, &SyntaxError{Clause: tok, Reason: "score cannot be negated"}
+		}
+		cmp, err := parseComparison(value)
+		if err != nil {
+			return Clause{}, &SyntaxError{Clause: tok, Reason: err.Error()}
+		}
+		return Clause{Kind: KindScore, Score: cmp}, nil
+	case "order":
+		if negated {
+			return Clause{}, &SyntaxError{Clause: tok, Reason: "order cannot be negated"}
+		}
+		o := Order(strings.ToLower(value))
+		if !o.valid() {
+			return Clause{}, &SyntaxError{Clause: tok, Reason: "order must be one of score, score_asc, id, id_asc, random"}
+		}
+		return Clause{Kind: KindOrder, Order: o}, nil
+	}
+
+	return Clause{Kind: KindTag, Negated: negated, Tags: []string{body}}, nil
+}
+
+func isMeta(tag string) bool {
+	name, _, found := strings.Cut(tag, ":")
+	if !found {
+		return false
+	}
+	switch strings.ToLower(name) {
+	case "rating", "score", "order":
+		return true
+	}
+	return false
+}
+
+var ratingNames = map[string]domain.Rating{
+	"g":            domain.RatingGeneral,
+	"general":      domain.RatingGeneral,
+	"safe":         domain.RatingGeneral,
+	"s":            domain.RatingSensitive,
+	"sensitive":    domain.RatingSensitive,
+	"q":            domain.RatingQuestionable,
+	"questionable": domain.RatingQuestionable,
+	"e":            domain.RatingExplicit,
+	"explicit":     domain.RatingExplicit,
+}
+
+func parseRatings(value string) ([]domain.Rating, error) {
+	var out []domain.Rating
+	seen := make(map[domain.Rating]bool)
+	for _, part := range strings.Split(value, ",") {
+		r, ok := ratingNames[strings.ToLower(strings.TrimSpace(part))]
+		if !ok {
+			return nil, fmt.Errorf("unknown rating %q (use g, s, q or e)", part)
+		}
+		if !seen[r] {
+			seen[r] = true
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func parseComparison(value string) (Comparison, error) {
+	if lo, hi, ok := strings.Cut(value, ".."); ok {
+		a, errA := strconv.Atoi(lo)
+		b, errB := strconv.Atoi(hi)
+		if errA != nil || errB != nil || a > b {
+			return Comparison{}, fmt.Errorf("range must be min..max")
+		}
+		return Comparison{Op: "..", Value: a, Max: b}, nil
+	}
+
+	op := "="
+	for _, candidate := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(value, candidate) {
+			op = candidate
+			value = value[len(candidate):]
+			break
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return Comparison{}, fmt.Errorf("expected a number, optionally prefixed with >, >=, < or <=")
+	}
+	return Comparison{Op: op, Value: n}, nil
+}
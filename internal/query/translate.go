@@ -0,0 +1,312 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// dialect describes how one family of booru APIs spells each clause.
+type dialect struct {
+	// ratings is the upstream spelling of every rating it can search for.
+	ratings map[domain.Rating]string
+	// ratingLists reports whether several ratings fit one clause (rating:g,s).
+	ratingLists bool
+	orders      map[Order]string
+	orGroup     func(tags []string) string
+	// singleOr dialects mark alternatives with a bare ~, so only one OR
+	// group per query is unambiguous.
+	singleOr    bool
+	scoreRanges bool
+}
+
+func tildeOr(tags []string) string {
+	return "~" + strings.Join(tags, " ~")
+}
+
+var tildeOrders = map[Order]string{
+	OrderScore:    "order:score",
+	OrderScoreAsc: "order:score_asc",
+	OrderID:       "order:id_desc",
+	OrderIDAsc:    "order:id",
+	OrderRandom:   "order:random",
+}
+
+// safeQuestionableExplicit is the three-level scheme of older boorus, where
+// "s" means safe.
+var safeQuestionableExplicit = map[domain.Rating]string{
+	domain.RatingGeneral:      "s",
+	domain.RatingQuestionable: "q",
+	domain.RatingExplicit:     "e",
+}
+
+var dialects = map[domain.QueryDialect]dialect{
+	domain.DialectDanbooru: {
+		ratings: map[domain.Rating]string{
+			domain.RatingGeneral:      "g",
+			domain.RatingSensitive:    "s",
+			domain.RatingQuestionable: "q",
+			domain.RatingExplicit:     "e",
+		},
+		ratingLists: true,
+		orders:      tildeOrders,
+		orGroup:     tildeOr,
+		singleOr:    true,
+		scoreRanges: true,
+	},
+	domain.DialectGelbooru: {
+		ratings: map[domain.Rating]string{
+			domain.RatingGeneral:      "general",
+			domain.RatingSensitive:    "sensitive",
+			domain.RatingQuestionable: "questionable",
+			domain.RatingExplicit:     "explicit",
+		},
+		orders: map[Order]string{
+			OrderScore:    "sort:score:desc",
+			OrderScoreAsc: "sort:score:asc",
+			OrderID:       "sort:id:desc",
+			OrderIDAsc:    "sort:id:asc",
+			OrderRandom:   "sort:random",
+		},
+		orGroup: func(tags []string) string {
+			return "{" + strings.Join(tags, " ~ ") + "}"
+		},
+	},
+	domain.DialectMoebooru: {
+		ratings:     safeQuestionableExplicit,
+		orders:      tildeOrders,
+		orGroup:     tildeOr,
+		singleOr:    true,
+		scoreRanges: true,
+	},
+	domain.DialectE621: {
+		ratings:     safeQuestionableExplicit,
+		orders:      tildeOrders,
+		orGroup:     tildeOr,
+		singleOr:    true,
+		scoreRanges: true,
+	},
+}
+
+// KnownDialect reports whether d can be translated to.
+func KnownDialect(d domain.QueryDialect) bool {
+	_, ok := dialects[d]
+	return ok
+}
+
+// Plan is a query split into the tags sent upstream and the clauses applied
+// to the mapped images afterwards.
+type Plan struct {
+	Upstream []string
+	Post     []Clause
+}
+
+// UnsupportedError reports a clause a strict source cannot express.
+type UnsupportedError struct {
+	Clause string
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("clause %q is not supported: %s", e.Clause, e.Reason)
+}
+
+// part is a clause and, when the source can express it, its upstream form.
+type part struct {
+	clause   Clause
+	upstream []string
+}
+
+// Translate writes q in the source's dialect. Clauses the source cannot
+// express end up in Plan.Post, or fail with an *UnsupportedError when the
+// source is strict or the clause is a native metatag.
+func Translate(q Query, caps domain.SourceCapabilities) (Plan, error) {
+	d := dialects[caps.Dialect]
+	var (
+		parts  []part
+		usedOr bool
+	)
+
+	for _, c := range q.Clauses {
+		out, reason := d.translate(c, caps, usedOr)
+		if reason != "" {
+			if caps.Strict || c.native() {
+				return Plan{}, &UnsupportedError{Clause: c.String(), Reason: reason}
+			}
+			parts = append(parts, part{clause: c})
+			continue
+		}
+		if c.Kind == KindOr {
+			usedOr = true
+		}
+		parts = append(parts, part{clause: c, upstream: out})
+	}
+
+	if err := capTags(parts, caps); err != nil {
+		return Plan{}, err
+	}
+
+	var plan Plan
+	for _, p := range parts {
+		if p.upstream == nil {
+			plan.Post = append(plan.Post, p.clause)
+			continue
+		}
+		plan.Upstream = append(plan.Upstream, p.upstream...)
+	}
+	return plan, nil
+}
+
+// translate returns the upstream form of c, or why the source can't express it.
+func (d dialect) translate(c Clause, caps domain.SourceCapabilities, usedOr bool) ([]string, string) {
+	if !caps.Wildcard {
+		for _, t := range c.Tags {
+			if strings.Contains(t, "*") {
+				return nil, "wildcards are not supported"
+			}
+		}
+	}
+
+	switch c.Kind {
+	case KindTag:
+		if !c.Negated {
+			return []string{c.Tags[0]}, ""
+		}
+		if !caps.Negation {
+			return nil, "negation is not supported"
+		}
+		return []string{"-" + c.Tags[0]}, ""
+	case KindOr:
+		if !caps.Or || d.orGroup == nil {
+			return nil, "OR is not supported"
+		}
+		if d.singleOr && usedOr {
+			return nil, "only one OR group per query is supported"
+		}
+		return []string{d.orGroup(c.Tags)}, ""
+	case KindRating:
+		if !caps.Rating {
+			return nil, "rating search is not supported"
+		}
+		if out := d.rating(c, caps.Negation); out != nil {
+			return out, ""
+		}
+		return nil, "this rating combination cannot be expressed"
+	case KindScore:
+		if !caps.Score {
+			return nil, "score search is not supported"
+		}
+		return d.score(c.Score), ""
+	case KindOrder:
+		if !caps.Sort {
+			return nil, "sorting is not supported"
+		}
+		if o := d.orders[c.Order]; o != "" {
+			return []string{o}, ""
+		}
+		return nil, "this order is not supported"
+	}
+	return nil, "unknown clause"
+}
+
+// capTags moves tag clauses to the post-filter until at most caps.MaxTags
+// tags go upstream: negations first, then OR groups, then plain tags, each
+// from the end of the query. Native metatags always stay upstream, so a
+// query with more of them than the source accepts fails.
+func capTags(parts []part, caps domain.SourceCapabilities) error {
+	if caps.MaxTags <= 0 {
+		return nil
+	}
+
+	count := 0
+	for _, p := range parts {
+		if p.upstream != nil {
+			count += tagCount(p.clause)
+		}
+	}
+
+	for _, kind := range []func(Clause) bool{
+		func(c Clause) bool { return c.Kind == KindTag && c.Negated },
+		func(c Clause) bool { return c.Kind == KindOr },
+		func(c Clause) bool { return c.Kind == KindTag },
+	} {
+		for i := len(parts) - 1; i >= 0 && count > caps.MaxTags; i-- {
+			p := &parts[i]
+			if p.upstream == nil || !kind(p.clause) || p.clause.native() {
+				continue
+			}
+			if caps.Strict {
+				return tooManyTags(p.clause, caps)
+			}
+			count -= tagCount(p.clause)
+			p.upstream = nil
+		}
+	}
+
+	for i := len(parts) - 1; i >= 0 && count > caps.MaxTags; i-- {
+		if parts[i].upstream != nil && parts[i].clause.native() {
+			return tooManyTags(parts[i].clause, caps)
+		}
+	}
+	return nil
+}
+
+func tooManyTags(c Clause, caps domain.SourceCapabilities) error {
+	return &UnsupportedError{
+		Clause: c.String(),
+		Reason: fmt.Sprintf("the source accepts at most %d tags", caps.MaxTags),
+	}
+}
+
+func tagCount(c Clause) int {
+	switch c.Kind {
+	case KindTag, KindOr:
+		return len(c.Tags)
+	}
+	return 0
+}
+
+func (d dialect) rating(c Clause, negation bool) []string {
+	values := make([]string, len(c.Ratings))
+	for i, r := range c.Ratings {
+		v, ok := d.ratings[r]
+		if !ok {
+			return nil
+		}
+		values[i] = v
+	}
+
+	prefix := "rating:"
+	if c.Negated {
+		if !negation {
+			return nil
+		}
+		prefix = "-rating:"
+	}
+
+	switch {
+	case len(values) == 1:
+		return []string{prefix + values[0]}
+	case d.ratingLists:
+		return []string{prefix + strings.Join(values, ",")}
+	case c.Negated:
+		// Excluding several ratings is just several exclusions.
+		out := make([]string, len(values))
+		for i, v := range values {
+			out[i] = prefix + v
+		}
+		return out
+	}
+	return nil
+}
+
+func (d dialect) score(c Comparison) []string {
+	if c.Op == ".." && !d.scoreRanges {
+		return []string{
+			"score:" + Comparison{Op: ">=", Value: c.Value}.String(),
+			"score:" + Comparison{Op: "<=", Value: c.Max}.String(),
+		}
+	}
+	return []string{"score:" + c.String()}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at Rate tokens per second up to Burst.
+// Tokens may be reserved ahead of time, which drives the balance negative;
+// the deficit is how long the next caller has to wait.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	b := &Bucket{last: time.Now()}
+	b.configure(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// configure changes the limits without resetting the current balance.
+func (b *Bucket) configure(rate float64, burst int) {
+	b.rate = rate
+	b.burst = float64(defaultBurst(rate, burst))
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// defaultBurst is burst, or ceil(rate) when unset.
+func defaultBurst(rate float64, burst int) int {
+	if burst <= 0 {
+		return int(math.Max(1, math.Ceil(rate)))
+	}
+	return burst
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// TryTake takes a token if one is available right now. Otherwise it returns
+// false and how long until one will be.
+func (b *Bucket) TryTake() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, b.deficitDelay(1 - b.tokens)
+}
+
+// Wait takes a token, sleeping until it is available. It gives up without
+// consuming anything if that would take longer than maxWait (returning the
+// expected delay) or if ctx ends first.
+func (b *Bucket) Wait(ctx context.Context, maxWait time.Duration) (time.Duration, error) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	delay := time.Duration(0)
+	if b.tokens < 1 {
+		delay = b.deficitDelay(1 - b.tokens)
+	}
+	if delay > maxWait {
+		b.mu.Unlock()
+		return delay, ErrLimited
+	}
+	b.tokens--
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return 0, nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return 0, nil
+	case <-ctx.Done():
+		b.giveBack()
+		return delay, ctx.Err()
+	}
+}
+
+func (b *Bucket) giveBack() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+func (b *Bucket) deficitDelay(deficit float64) time.Duration {
+	if b.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(deficit / b.rate * float64(time.Second))
+}
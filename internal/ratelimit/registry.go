@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrLimited is returned when a request would exceed its rate limit.
+var ErrLimited = errors.New("rate limit exceeded")
+
+type limits struct {
+	rate  float64
+	burst int
+}
+
+// Registry hands out one Bucket per key (a source code or upstream host),
+// updating its limits in place when the configuration changes.
+type Registry struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+	// users holds the limits each user (source) asked for per key. A bucket
+	// shared by several users runs at the strictest of them, so sources on
+	// the same host can't loosen each other's limits.
+	users map[string]map[string]limits
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		buckets: map[string]*Bucket{},
+		users:   map[string]map[string]limits{},
+	}
+}
+
+// Bucket returns the bucket for key, recording rate and burst as user's
+// limits for it.
+func (r *Registry) Bucket(key, user string, rate float64, burst int) *Bucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.users[key] == nil {
+		r.users[key] = map[string]limits{}
+	}
+	r.users[key][user] = limits{rate: rate, burst: defaultBurst(rate, burst)}
+	rate, burst = strictest(r.users[key])
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = NewBucket(rate, burst)
+		r.buckets[key] = b
+		return b
+	}
+
+	b.mu.Lock()
+	b.configure(rate, burst)
+	b.mu.Unlock()
+	return b
+}
+
+func strictest(users map[string]limits) (float64, int) {
+	first := true
+	var out limits
+	for _, l := range users {
+		if first || l.rate < out.rate {
+			out.rate = l.rate
+		}
+		if first || l.burst < out.burst {
+			out.burst = l.burst
+		}
+		first = false
+	}
+	return out.rate, out.burst
+}
@@ -5,19 +5,30 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 
 	"github.com/freikugel0/boorumesh-be/internal/domain"
 	"github.com/freikugel0/boorumesh-be/internal/repository"
+	"github.com/freikugel0/boorumesh-be/internal/secret"
 )
 
+const sourceColumns = `id, code, name, base_url, enabled, request, mapping, defaults, auth, capabilities, created_at, updated_at, deleted_at`
+
+// SourceRepositoryPostgres stores sources in the sources table. Auth
+// sections are encrypted with box before they reach the database; box may
+// be nil as long as no source uses auth.
 type SourceRepositoryPostgres struct {
-	db *sql.DB
+	db  *sql.DB
+	box *secret.Box
 }
 
-func NewSourceRepositoryPostgres(db *sql.DB) *SourceRepositoryPostgres {
-	return &SourceRepositoryPostgres{db: db}
+func NewSourceRepositoryPostgres(db *sql.DB, box *secret.Box) *SourceRepositoryPostgres {
+	return &SourceRepositoryPostgres{db: db, box: box}
 }
 
 func (r *SourceRepositoryPostgres) Create(ctx context.Context, src domain.Source) (domain.Source, error) {
@@ -33,10 +44,18 @@ func (r *SourceRepositoryPostgres) Create(ctx context.Context, src domain.Source
 	if err != nil {
 		return domain.Source{}, err
 	}
+	authEnc, err := r.sealAuth(src.Code, src.Auth)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	capJSON, err := json.Marshal(src.Capabilities)
+	if err != nil {
+		return domain.Source{}, err
+	}
 
 	const q = `
-INSERT INTO sources (code, name, base_url, enabled, request, mapping, defaults)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+INSERT INTO sources (code, name, base_url, enabled, request, mapping, defaults, auth, capabilities)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 RETURNING id, created_at, updated_at;
 `
 
@@ -48,12 +67,14 @@ RETURNING id, created_at, updated_at;
 		reqJSON,
 		mapJSON,
 		defJSON,
+		authEnc,
+		capJSON,
 	)
 
 	if err := row.Scan(&src.ID, &src.CreatedAt, &src.UpdatedAt); err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
-			return domain.Source{}, repository.ErrSourceExists
+			return domain.Source{}, r.existsError(ctx, src.Code)
 		}
 		return domain.Source{}, err
 	}
@@ -61,21 +82,219 @@ RETURNING id, created_at, updated_at;
 	return src, nil
 }
 
+// existsError tells a code held by a soft-deleted source apart from one in
+// use, since the former can't be seen through any other lookup.
+func (r *SourceRepositoryPostgres) existsError(ctx context.Context, code domain.SourceCode) error {
+	const q = `SELECT deleted_at IS NOT NULL FROM sources WHERE code = $1;`
+
+	var deleted bool
+	if err := r.db.QueryRowContext(ctx, q, code).Scan(&deleted); err == nil && deleted {
+		return repository.ErrSourceDeleted
+	}
+	return repository.ErrSourceExists
+}
+
 func (r *SourceRepositoryPostgres) GetByCode(ctx context.Context, code domain.SourceCode) (domain.Source, error) {
+	const q = `
+SELECT ` + sourceColumns + `
+FROM sources
+WHERE code = $1 AND deleted_at IS NULL;
+`
+
+	src, err := r.scanSource(r.db.QueryRowContext(ctx, q, code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.Source{}, repository.ErrNotFound
+		}
+		return domain.Source{}, err
+	}
+
+	return src, nil
+}
+
+func (r *SourceRepositoryPostgres) ListEnabled(ctx context.Context) ([]domain.Source, error) {
+	const q = `
+SELECT ` + sourceColumns + `
+FROM sources
+WHERE enabled = TRUE AND deleted_at IS NULL
+ORDER BY code;
+`
+
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return r.scanSources(rows)
+}
+
+func (r *SourceRepositoryPostgres) List(ctx context.Context, f repository.SourceFilter) ([]domain.Source, error) {
+	var (
+		where []string
+		args  []any
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Deleted {
+		where = append(where, "deleted_at IS NOT NULL")
+	} else {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if f.Enabled != nil {
+		where = append(where, "enabled = "+arg(*f.Enabled))
+	}
+	if f.CodePrefix != "" {
+		where = append(where, "code LIKE "+arg(escapeLike(f.CodePrefix)+"%"))
+	}
+	if f.Query != "" {
+		where = append(where, "name ILIKE "+arg("%"+escapeLike(f.Query)+"%"))
+	}
+	if f.AfterID > 0 {
+		where = append(where, "id > "+arg(f.AfterID))
+	}
+
+	q := `
+SELECT ` + sourceColumns + `
+FROM sources
+WHERE ` + strings.Join(where, " AND ") + `
+ORDER BY id
+LIMIT ` + arg(f.Limit) + `;
+`
+
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return r.scanSources(rows)
+}
+
+func (r *SourceRepositoryPostgres) Update(ctx context.Context, src domain.Source, expectedUpdatedAt time.Time) (domain.Source, error) {
+	reqJSON, err := json.Marshal(src.Request)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	mapJSON, err := json.Marshal(src.Mapping)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	defJSON, err := json.Marshal(src.Defaults)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	authEnc, err := r.sealAuth(src.Code, src.Auth)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	capJSON, err := json.Marshal(src.Capabilities)
+	if err != nil {
+		return domain.Source{}, err
+	}
+
+	// updated_at is always moved forward, even if two updates land within the
+	// same clock tick, so it stays usable as a version.
+	const q = `
+UPDATE sources
+SET name = $2,
+    base_url = $3,
+    enabled = $4,
+    request = $5,
+    mapping = $6,
+    defaults = $7,
+    auth = $9,
+    capabilities = $10,
+    updated_at = GREATEST(now(), updated_at + interval '1 microsecond')
+WHERE code = $1 AND updated_at = $8 AND deleted_at IS NULL
+RETURNING ` + sourceColumns + `;
+`
+
+	out, err := r.scanSource(r.db.QueryRowContext(ctx, q,
+		src.Code,
+		src.Name,
+		src.BaseURL,
+		src.Enabled,
+		reqJSON,
+		mapJSON,
+		defJSON,
+		expectedUpdatedAt,
+		authEnc,
+		capJSON,
+	))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return domain.Source{}, err
+		}
+		// Nothing matched: either the source is gone or someone else won the race.
+		if _, err := r.GetByCode(ctx, src.Code); err != nil {
+			return domain.Source{}, err
+		}
+		return domain.Source{}, repository.ErrConflict
+	}
+
+	return out, nil
+}
+
+func (r *SourceRepositoryPostgres) Delete(ctx context.Context, code domain.SourceCode) error {
+	const q = `
+UPDATE sources
+SET deleted_at = now(),
+    updated_at = GREATEST(now(), updated_at + interval '1 microsecond')
+WHERE code = $1 AND deleted_at IS NULL;
+`
+
+	res, err := r.db.ExecContext(ctx, q, code)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+func (r *SourceRepositoryPostgres) Restore(ctx context.Context, code domain.SourceCode) (domain.Source, error) {
+	const q = `
+UPDATE sources
+SET deleted_at = NULL,
+    updated_at = GREATEST(now(), updated_at + interval '1 microsecond')
+WHERE code = $1 AND deleted_at IS NOT NULL
+RETURNING ` + sourceColumns + `;
+`
+
+	src, err := r.scanSource(r.db.QueryRowContext(ctx, q, code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.Source{}, repository.ErrNotFound
+		}
+		return domain.Source{}, err
+	}
+
+	return src, nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func (r *SourceRepositoryPostgres) scanSource(row rowScanner) (domain.Source, error) {
 	var (
 		src     domain.Source
 		reqJSON []byte
 		mapJSON []byte
 		defJSON []byte
+		authEnc []byte
+		capJSON []byte
+		deleted sql.NullTime
 	)
 
-	const q = `
-SELECT id, code, name, base_url, enabled, request, mapping, defaults, created_at, updated_at
-FROM sources
-WHERE code = $1;
-`
-
-	err := r.db.QueryRowContext(ctx, q, code).Scan(
+	err := row.Scan(
 		&src.ID,
 		&src.Code,
 		&src.Name,
@@ -84,15 +303,18 @@ WHERE code = $1;
 		&reqJSON,
 		&mapJSON,
 		&defJSON,
+		&authEnc,
+		&capJSON,
 		&src.CreatedAt,
 		&src.UpdatedAt,
+		&deleted,
 	)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return domain.Source{}, repository.ErrNotFound
-		}
 		return domain.Source{}, err
 	}
+	if deleted.Valid {
+		src.DeletedAt = &deleted.Time
+	}
 
 	if err := json.Unmarshal(reqJSON, &src.Request); err != nil {
 		return domain.Source{}, err
@@ -103,6 +325,67 @@ WHERE code = $1;
 	if err := json.Unmarshal(defJSON, &src.Defaults); err != nil {
 		return domain.Source{}, err
 	}
+	// One undecryptable row must not take down every listing; the source
+	// is returned marked instead.
+	if src.Auth, err = r.openAuth(src.Code, authEnc); err != nil {
+		log.Printf("source %s: %v", src.Code, err)
+		src.AuthError = err.Error()
+	}
+	if len(capJSON) > 0 {
+		if err := json.Unmarshal(capJSON, &src.Capabilities); err != nil {
+			return domain.Source{}, err
+		}
+	}
 
 	return src, nil
 }
+
+func (r *SourceRepositoryPostgres) scanSources(rows *sql.Rows) ([]domain.Source, error) {
+	defer rows.Close()
+
+	var out []domain.Source
+	for rows.Next() {
+		src, err := r.scanSource(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, src)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// sealAuth encrypts an auth section, bound to the source code.
+func (r *SourceRepositoryPostgres) sealAuth(code domain.SourceCode, auth *domain.SourceAuth) ([]byte, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	plain, err := json.Marshal(auth)
+	if err != nil {
+		return nil, err
+	}
+	return r.box.Seal(plain, []byte(code))
+}
+
+func (r *SourceRepositoryPostgres) openAuth(code domain.SourceCode, enc []byte) (*domain.SourceAuth, error) {
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	plain, err := r.box.Open(enc, []byte(code))
+	if err != nil {
+		return nil, fmt.Errorf("source %s auth: %w", code, err)
+	}
+	var auth domain.SourceAuth
+	if err := json.Unmarshal(plain, &auth); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+// escapeLike escapes LIKE/ILIKE wildcards so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
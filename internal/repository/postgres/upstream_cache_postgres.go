@@ -0,0 +1,78 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/freikugel0/boorumesh-be/internal/cache"
+)
+
+const defaultCacheMaxEntries = 1000
+
+// UpstreamCachePostgres is a cache.Cache backed by the upstream_cache table,
+// so cached responses are shared between instances and survive restarts.
+type UpstreamCachePostgres struct {
+	db *sql.DB
+}
+
+func NewUpstreamCachePostgres(db *sql.DB) *UpstreamCachePostgres {
+	return &UpstreamCachePostgres{db: db}
+}
+
+func (c *UpstreamCachePostgres) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	const q = `
+UPDATE upstream_cache
+SET accessed_at = now()
+WHERE key = $1 AND expires_at > now()
+RETURNING value;
+`
+
+	var value []byte
+	if err := c.db.QueryRowContext(ctx, q, key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (c *UpstreamCachePostgres) Set(ctx context.Context, key string, value []byte, opts cache.Options) error {
+	if opts.TTL <= 0 {
+		return nil
+	}
+	maxEntries := opts.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+
+	const upsert = `
+INSERT INTO upstream_cache (key, namespace, value, expires_at, accessed_at)
+VALUES ($1, $2, $3, now() + $4 * interval '1 millisecond', now())
+ON CONFLICT (key) DO UPDATE
+SET value = EXCLUDED.value,
+    expires_at = EXCLUDED.expires_at,
+    accessed_at = EXCLUDED.accessed_at;
+`
+	if _, err := c.db.ExecContext(ctx, upsert, key, opts.Namespace, value, opts.TTL.Milliseconds()); err != nil {
+		return err
+	}
+
+	// Drop expired rows and everything past the namespace budget, least
+	// recently used first.
+	const trim = `
+DELETE FROM upstream_cache
+WHERE namespace = $1
+  AND (expires_at <= now()
+       OR key IN (
+         SELECT key FROM upstream_cache
+         WHERE namespace = $1
+         ORDER BY accessed_at DESC
+         OFFSET $2
+       ));
+`
+	_, err := c.db.ExecContext(ctx, trim, opts.Namespace, maxEntries)
+	return err
+}
@@ -2,20 +2,44 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"github.com/freikugel0/boorumesh-be/internal/domain"
 )
 
 var (
-	ErrSourceExists = fmtError("source already exists")
-	ErrNotFound     = fmtError("not found")
+	ErrSourceExists  = fmtError("source already exists")
+	ErrSourceDeleted = fmtError("source is soft-deleted; restore it or choose another code")
+	ErrNotFound      = fmtError("not found")
+	ErrConflict      = fmtError("source was modified concurrently")
 )
 
 type fmtError string
 
 func (e fmtError) Error() string { return string(e) }
 
+// SourceFilter narrows down List results. Results are ordered by id and
+// paginated by keyset: pass the last seen id as AfterID to get the next page.
+type SourceFilter struct {
+	Enabled    *bool
+	CodePrefix string
+	Query      string // case-insensitive substring match on name
+	Deleted    bool   // list soft-deleted sources instead of live ones
+	AfterID    int64
+	Limit      int
+}
+
 type SourceRepository interface {
 	Create(ctx context.Context, src domain.Source) (domain.Source, error)
 	GetByCode(ctx context.Context, code domain.SourceCode) (domain.Source, error)
+	ListEnabled(ctx context.Context) ([]domain.Source, error)
+	// Update overwrites the mutable fields of src, identified by src.Code.
+	// It only succeeds while the stored updated_at still equals
+	// expectedUpdatedAt, otherwise ErrConflict is returned.
+	Update(ctx context.Context, src domain.Source, expectedUpdatedAt time.Time) (domain.Source, error)
+	List(ctx context.Context, f SourceFilter) ([]domain.Source, error)
+	// Delete soft-deletes a source; it disappears from every other lookup
+	// until Restore is called.
+	Delete(ctx context.Context, code domain.SourceCode) error
+	Restore(ctx context.Context, code domain.SourceCode) (domain.Source, error)
 }
@@ -0,0 +1,90 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNoKey     = errors.New("secret key not configured")
+	ErrDecrypt   = errors.New("failed to decrypt secret")
+	errBadFormat = errors.New("unsupported ciphertext format")
+)
+
+const formatV1 byte = 1
+
+// Box encrypts small secrets with AES-256-GCM. Ciphertexts are
+// version byte || nonce || sealed data, and are bound to an associated
+// value (e.g. the owning source code) so they cannot be moved between rows.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// ParseKey accepts a 32-byte key encoded as base64 (std or URL) or hex.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	for _, dec := range []func(string) ([]byte, error){
+		base64.StdEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+		base64.RawURLEncoding.DecodeString,
+		hex.DecodeString,
+	} {
+		if key, err := dec(s); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("secret key must be 32 bytes encoded as base64 or hex")
+}
+
+func NewBox(key []byte) (*Box, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+func (b *Box) Seal(plaintext, associated []byte) ([]byte, error) {
+	if b == nil {
+		return nil, ErrNoKey
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+len(nonce)+len(plaintext)+b.aead.Overhead())
+	out = append(out, formatV1)
+	out = append(out, nonce...)
+	return b.aead.Seal(out, nonce, plaintext, associated), nil
+}
+
+func (b *Box) Open(ciphertext, associated []byte) ([]byte, error) {
+	if b == nil {
+		return nil, ErrNoKey
+	}
+
+	ns := b.aead.NonceSize()
+	if len(ciphertext) < 1+ns || ciphertext[0] != formatV1 {
+		return nil, errBadFormat
+	}
+	nonce, sealed := ciphertext[1:1+ns], ciphertext[1+ns:]
+
+	plaintext, err := b.aead.Open(nil, nonce, sealed, associated)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
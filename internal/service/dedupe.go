@@ -0,0 +1,68 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// sourceRanker returns a comparison for duplicate resolution: sources named
+// in prefer come first, in that order, then the rest by Defaults.Priority.
+// less(a, b) reports whether a copy from a should be kept over one from b.
+func sourceRanker(sources []domain.Source, prefer []domain.SourceCode) func(a, b domain.SourceCode) bool {
+	preferred := make(map[domain.SourceCode]int, len(prefer))
+	for i, code := range prefer {
+		if _, dup := preferred[code]; !dup {
+			preferred[code] = i
+		}
+	}
+	priority := make(map[domain.SourceCode]int, len(sources))
+	for _, src := range sources {
+		priority[src.Code] = src.Defaults.Priority
+	}
+
+	return func(a, b domain.SourceCode) bool {
+		pa, aPreferred := preferred[a]
+		pb, bPreferred := preferred[b]
+		switch {
+		case aPreferred && bPreferred:
+			return pa < pb
+		case aPreferred != bPreferred:
+			return aPreferred
+		}
+		return priority[a] > priority[b]
+	}
+}
+
+// dedupeByMD5 folds images with the same MD5 into one, keeping the copy from
+// the best-ranked source at the position where the group first appeared and
+// listing the others in AlsoOn. Images without an MD5 are left alone.
+func dedupeByMD5(images []domain.Image, better func(a, b domain.SourceCode) bool) []domain.Image {
+	groups := make(map[string]int, len(images)) // md5 → index in out
+	out := make([]domain.Image, 0, len(images))
+
+	for _, img := range images {
+		key := strings.ToLower(strings.TrimSpace(img.MD5))
+		if key == "" {
+			out = append(out, img)
+			continue
+		}
+
+		i, seen := groups[key]
+		if !seen {
+			groups[key] = len(out)
+			out = append(out, img)
+			continue
+		}
+
+		kept := out[i]
+		if better(img.Upstream, kept.Upstream) {
+			img.AlsoOn = append(kept.AlsoOn, domain.ImageRef{Upstream: kept.Upstream, ID: kept.ID})
+			out[i] = img
+		} else {
+			out[i].AlsoOn = append(kept.AlsoOn, domain.ImageRef{Upstream: img.Upstream, ID: img.ID})
+		}
+	}
+
+	return out
+}
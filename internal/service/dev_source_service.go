@@ -1,64 +1,443 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/freikugel0/boorumesh-be/internal/breaker"
 	"github.com/freikugel0/boorumesh-be/internal/domain"
+	"github.com/freikugel0/boorumesh-be/internal/media"
+	"github.com/freikugel0/boorumesh-be/internal/query"
 	"github.com/freikugel0/boorumesh-be/internal/repository"
 )
 
-var ErrSourceNotFound = errors.New("source not found")
+var (
+	ErrSourceNotFound = errors.New("source not found")
+	ErrSourceConflict = errors.New("source was modified concurrently")
+	ErrInvalidSource  = errors.New("invalid source")
+)
+
+// validationError carries a user-facing message while still matching
+// ErrInvalidSource via errors.Is.
+type validationError string
+
+func (e validationError) Error() string        { return string(e) }
+func (e validationError) Is(target error) bool { return target == ErrInvalidSource }
 
 type DevSourceService interface {
 	CreateSource(ctx context.Context, in CreateSourceInput) (domain.Source, error)
 	GetSourceByCode(ctx context.Context, code string) (domain.Source, error)
+	UpdateSource(ctx context.Context, code string, in UpdateSourceInput) (domain.Source, error)
+	ListSources(ctx context.Context, in ListSourcesInput) (SourceList, error)
+	DeleteSource(ctx context.Context, code string) error
+	RestoreSource(ctx context.Context, code string) (domain.Source, error)
+	MappingStats(ctx context.Context) []MappingStats
+	BreakerStates(ctx context.Context) []breaker.Snapshot
+	TestSource(ctx context.Context, in TestSourceInput) (ProbeResult, error)
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+type ListSourcesInput struct {
+	Enabled    *bool
+	CodePrefix string
+	Query      string
+	Deleted    bool
+	Cursor     string
+	Limit      int
+}
+
+// SourceList is one page of sources. NextCursor is empty on the last page.
+type SourceList struct {
+	Items      []domain.Source `json:"items"`
+	NextCursor string          `json:"next_cursor,omitempty"`
 }
 
 type CreateSourceInput struct {
-	Code     string                `json:"code"`
-	Name     string                `json:"name"`
-	BaseURL  string                `json:"base_url"`
-	Enabled  *bool                 `json:"enabled,omitempty"`
-	Request  domain.RequestConfig  `json:"request"`
-	Mapping  domain.SourceMapping  `json:"mapping"`
-	Defaults domain.SourceDefaults `json:"defaults"`
+	Code         string                     `json:"code"`
+	Name         string                     `json:"name"`
+	BaseURL      string                     `json:"base_url"`
+	Enabled      *bool                      `json:"enabled,omitempty"`
+	Request      domain.RequestConfig       `json:"request"`
+	Mapping      domain.SourceMapping       `json:"mapping"`
+	Defaults     domain.SourceDefaults      `json:"defaults"`
+	Auth         *domain.SourceAuth         `json:"auth,omitempty"`
+	Capabilities *domain.SourceCapabilities `json:"capabilities,omitempty"`
+}
+
+// TestSourceInput is a dry run of an unsaved source config against either
+// its live upstream or a pasted sample body.
+type TestSourceInput struct {
+	Source     CreateSourceInput `json:"source"`
+	Sample     json.RawMessage   `json:"sample,omitempty"`
+	Tags       string            `json:"tags,omitempty"`
+	Page       int               `json:"page,omitempty"`
+	Limit      int               `json:"limit,omitempty"`
+	Raw        bool              `json:"raw,omitempty"`
+	MaxRecords int               `json:"max_records,omitempty"`
+}
+
+// UpdateSourceInput is a JSON merge patch (RFC 7386) over the mutable fields
+// of a source. ExpectedUpdatedAt, when set, must match the stored updated_at.
+type UpdateSourceInput struct {
+	Patch             json.RawMessage
+	ExpectedUpdatedAt *time.Time
 }
 
+// patchableSource is the document a merge patch is applied to.
+type patchableSource struct {
+	Name         string                     `json:"name"`
+	BaseURL      string                     `json:"base_url"`
+	Enabled      bool                       `json:"enabled"`
+	Request      domain.RequestConfig       `json:"request"`
+	Mapping      domain.SourceMapping       `json:"mapping"`
+	Defaults     domain.SourceDefaults      `json:"defaults"`
+	Auth         *domain.SourceAuth         `json:"auth"`
+	Capabilities *domain.SourceCapabilities `json:"capabilities"`
+}
+
+// nullablePatchFields are the patchableSource fields a patch may remove.
+var nullablePatchFields = map[string]bool{"auth": true, "capabilities": true}
+
 type devSourceService struct {
-	repo repository.SourceRepository
+	repo    repository.SourceRepository
+	fetcher SourceFetchService
+	// mediaProxy is false when the server has no media signing key, so
+	// sources can't use proxy_media.
+	mediaProxy bool
 }
 
-func NewDevSourceService(repo repository.SourceRepository) DevSourceService {
-	return &devSourceService{repo: repo}
+func NewDevSourceService(repo repository.SourceRepository, fetcher SourceFetchService, mediaProxy bool) DevSourceService {
+	return &devSourceService{repo: repo, fetcher: fetcher, mediaProxy: mediaProxy}
 }
 
 func (s *devSourceService) CreateSource(ctx context.Context, in CreateSourceInput) (domain.Source, error) {
+	src, err := s.build(in)
+	if err != nil {
+		return domain.Source{}, err
+	}
+
+	out, err := s.repo.Create(ctx, src)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	return out, nil
+}
+
+func (s *devSourceService) GetSourceByCode(ctx context.Context, code string) (domain.Source, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return domain.Source{}, validationError("code is required")
+	}
+
+	src, err := s.repo.GetByCode(ctx, domain.SourceCode(code))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return domain.Source{}, ErrSourceNotFound
+		}
+		return domain.Source{}, err
+	}
+
+	return src, nil
+}
+
+func (s *devSourceService) UpdateSource(ctx context.Context, code string, in UpdateSourceInput) (domain.Source, error) {
+	current, err := s.GetSourceByCode(ctx, code)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	if in.ExpectedUpdatedAt != nil && !sameVersion(*in.ExpectedUpdatedAt, current.UpdatedAt) {
+		return domain.Source{}, ErrSourceConflict
+	}
+
+	var patch any
+	if err := json.Unmarshal(in.Patch, &patch); err != nil {
+		return domain.Source{}, validationError("patch must be valid json")
+	}
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return domain.Source{}, validationError("patch must be a json object")
+	}
+
+	// Apply the patch to the current document, then run it through the same
+	// validation and defaulting as a freshly created source.
+	doc, err := toJSONValue(patchableSource{
+		Name:         current.Name,
+		BaseURL:      current.BaseURL,
+		Enabled:      current.Enabled,
+		Request:      current.Request,
+		Mapping:      current.Mapping,
+		Defaults:     current.Defaults,
+		Auth:         current.Auth,
+		Capabilities: current.Capabilities,
+	})
+	if err != nil {
+		return domain.Source{}, err
+	}
+	docObj := doc.(map[string]any)
+	for key, v := range patchObj {
+		if _, ok := docObj[key]; !ok {
+			return domain.Source{}, validationError(fmt.Sprintf("field %q cannot be patched", key))
+		}
+		// Removing a required field would otherwise decode as its zero
+		// value, e.g. "enabled": null silently disabling the source.
+		if v == nil && !nullablePatchFields[key] {
+			return domain.Source{}, validationError(fmt.Sprintf("field %q cannot be null", key))
+		}
+	}
+	if _, ok := patchObj["auth"]; current.AuthError != "" && !ok {
+		// Saving now would silently drop the credentials we couldn't read.
+		return domain.Source{}, validationError("stored auth could not be decrypted; send a new auth section (or null to remove it)")
+	}
+
+	merged, err := json.Marshal(mergePatch(doc, patchObj))
+	if err != nil {
+		return domain.Source{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	var next patchableSource
+	if err := dec.Decode(&next); err != nil {
+		return domain.Source{}, validationError(fmt.Sprintf("invalid patch: %v", err))
+	}
+	keepRedactedSecrets(&next, current)
+
+	src, err := s.build(CreateSourceInput{
+		Code:         string(current.Code),
+		Name:         next.Name,
+		BaseURL:      next.BaseURL,
+		Enabled:      &next.Enabled,
+		Request:      next.Request,
+		Mapping:      next.Mapping,
+		Defaults:     next.Defaults,
+		Auth:         next.Auth,
+		Capabilities: next.Capabilities,
+	})
+	if err != nil {
+		return domain.Source{}, err
+	}
+
+	out, err := s.repo.Update(ctx, src, current.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			return domain.Source{}, ErrSourceNotFound
+		case errors.Is(err, repository.ErrConflict):
+			return domain.Source{}, ErrSourceConflict
+		}
+		return domain.Source{}, err
+	}
+	return out, nil
+}
+
+func (s *devSourceService) ListSources(ctx context.Context, in ListSourcesInput) (SourceList, error) {
+	limit := in.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	var afterID int64
+	if in.Cursor != "" {
+		id, err := strconv.ParseInt(in.Cursor, 10, 64)
+		if err != nil || id < 0 {
+			return SourceList{}, validationError("cursor invalid")
+		}
+		afterID = id
+	}
+
+	// Ask for one extra row to know whether another page exists.
+	items, err := s.repo.List(ctx, repository.SourceFilter{
+		Enabled:    in.Enabled,
+		CodePrefix: strings.TrimSpace(in.CodePrefix),
+		Query:      strings.TrimSpace(in.Query),
+		Deleted:    in.Deleted,
+		AfterID:    afterID,
+		Limit:      limit + 1,
+	})
+	if err != nil {
+		return SourceList{}, err
+	}
+
+	out := SourceList{Items: items}
+	if len(items) > limit {
+		out.Items = items[:limit]
+		out.NextCursor = strconv.FormatInt(out.Items[limit-1].ID, 10)
+	}
+	if out.Items == nil {
+		out.Items = []domain.Source{}
+	}
+
+	return out, nil
+}
+
+func (s *devSourceService) DeleteSource(ctx context.Context, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return validationError("code is required")
+	}
+
+	if err := s.repo.Delete(ctx, domain.SourceCode(code)); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrSourceNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *devSourceService) RestoreSource(ctx context.Context, code string) (domain.Source, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return domain.Source{}, validationError("code is required")
+	}
+
+	src, err := s.repo.Restore(ctx, domain.SourceCode(code))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return domain.Source{}, ErrSourceNotFound
+		}
+		return domain.Source{}, err
+	}
+
+	return src, nil
+}
+
+func (s *devSourceService) MappingStats(ctx context.Context) []MappingStats {
+	return s.fetcher.MappingStats()
+}
+
+func (s *devSourceService) BreakerStates(ctx context.Context) []breaker.Snapshot {
+	return s.fetcher.BreakerStates()
+}
+
+func (s *devSourceService) TestSource(ctx context.Context, in TestSourceInput) (ProbeResult, error) {
+	if strings.TrimSpace(in.Source.Code) == "" {
+		in.Source.Code = "test"
+	}
+	src, err := s.build(in.Source)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+
+	out, err := s.fetcher.Probe(ctx, src, ProbeInput{
+		Sample:     in.Sample,
+		Tags:       strings.Fields(in.Tags),
+		Page:       in.Page,
+		Limit:      in.Limit,
+		Raw:        in.Raw,
+		MaxRecords: in.MaxRecords,
+	})
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	return out, nil
+}
+
+// build is buildSource plus the checks that depend on the server's
+// configuration.
+func (s *devSourceService) build(in CreateSourceInput) (domain.Source, error) {
+	src, err := buildSource(in)
+	if err != nil {
+		return domain.Source{}, err
+	}
+	if src.Mapping.ProxyMedia && !s.mediaProxy {
+		return domain.Source{}, validationError("mapping.proxy_media requires the server to have MEDIA_SIGNING_KEY set")
+	}
+	return src, nil
+}
+
+// buildSource validates the input and fills in defaults, producing the
+// source that would be persisted.
+func buildSource(in CreateSourceInput) (domain.Source, error) {
 	code := strings.TrimSpace(in.Code)
 	name := strings.TrimSpace(in.Name)
 	base := strings.TrimSpace(in.BaseURL)
 
 	if code == "" {
-		return domain.Source{}, errors.New("code is required")
+		return domain.Source{}, validationError("code is required")
+	}
+	if code == media.ReservedCode {
+		return domain.Source{}, validationError(fmt.Sprintf("code %q is reserved", code))
 	}
 	if name == "" {
-		return domain.Source{}, errors.New("name is required")
+		return domain.Source{}, validationError("name is required")
 	}
 	if base == "" {
-		return domain.Source{}, errors.New("base_url is required")
+		return domain.Source{}, validationError("base_url is required")
 	}
 	if _, err := url.ParseRequestURI(base); err != nil {
-		return domain.Source{}, errors.New("base_url invalid")
+		return domain.Source{}, validationError("base_url invalid")
 	}
 	if strings.TrimSpace(in.Request.PostsPath) == "" {
-		return domain.Source{}, errors.New("request.posts_path is required")
+		return domain.Source{}, validationError("request.posts_path is required")
+	}
+	switch in.Request.ResponseFormat {
+	case "", domain.ResponseFormatJSON, domain.ResponseFormatXML:
+	default:
+		return domain.Source{}, validationError("request.response_format must be 'json' or 'xml'")
+	}
+	switch in.Request.Pagination {
+	case "", domain.PaginationPage, domain.PaginationPID, domain.PaginationOffset, domain.PaginationCursor:
+	default:
+		return domain.Source{}, validationError("request.pagination must be one of page, pid, offset, cursor")
+	}
+	if in.Request.PostPath != "" && in.Request.PostIDParam != "" {
+		return domain.Source{}, validationError("request.post_path and request.post_id_param are mutually exclusive")
+	}
+	if in.Request.PostPath != "" && !strings.Contains(in.Request.PostPath, "{id}") {
+		return domain.Source{}, validationError("request.post_path must contain {id}")
+	}
+	for name, path := range map[string]string{
+		"response_root": in.Request.ResponseRoot,
+		"total_path":    in.Request.TotalPath,
+		"post_root":     in.Request.PostRoot,
+	} {
+		if strings.TrimSpace(path) == "" {
+			continue
+		}
+		if _, err := parseFieldPath(path); err != nil {
+			return domain.Source{}, validationError(fmt.Sprintf("request.%s: %v", name, err))
+		}
 	}
 	if in.Mapping.Fields == nil ||
-		in.Mapping.Fields["id"].Key == "" ||
-		in.Mapping.Fields["file_url"].Key == "" {
-		return domain.Source{}, errors.New("mapping.fields must include at least 'id' and 'file_url'")
+		!fieldMapped(in.Mapping.Fields["id"]) ||
+		!fieldMapped(in.Mapping.Fields["file_url"]) {
+		return domain.Source{}, validationError("mapping.fields must include at least 'id' and 'file_url'")
+	}
+	for name, field := range in.Mapping.Fields {
+		if err := validateFieldMapping(field); err != nil {
+			return domain.Source{}, validationError(fmt.Sprintf("mapping.fields.%s.%v", name, err))
+		}
+	}
+
+	mapping := in.Mapping
+	if len(mapping.Ratings) > 0 {
+		// Upstream values are matched case-insensitively.
+		ratings := make(map[string]domain.Rating, len(mapping.Ratings))
+		for value, rating := range mapping.Ratings {
+			if !rating.Valid() {
+				return domain.Source{}, validationError(fmt.Sprintf("mapping.ratings.%s: invalid rating %q", value, rating))
+			}
+			ratings[strings.ToLower(strings.TrimSpace(value))] = rating
+		}
+		mapping.Ratings = ratings
+	}
+	if mapping.RatingFallback != "" && !mapping.RatingFallback.Valid() {
+		return domain.Source{}, validationError(fmt.Sprintf("mapping.rating_fallback: invalid rating %q", mapping.RatingFallback))
 	}
 
 	req := in.Request
@@ -77,6 +456,17 @@ func (s *devSourceService) CreateSource(ctx context.Context, in CreateSourceInpu
 	if _, ok := req.Headers["User-Agent"]; !ok {
 		req.Headers["User-Agent"] = "boorumesh/1.0"
 	}
+	if req.MediaMaxBytes < 0 {
+		return domain.Source{}, validationError("request.media_max_bytes must not be negative")
+	}
+	for _, host := range req.MediaHosts {
+		if strings.TrimSpace(host) == "" || strings.Contains(host, "/") {
+			return domain.Source{}, validationError(fmt.Sprintf("request.media_hosts: invalid host %q", host))
+		}
+	}
+	if mapping.ProxyMedia && len(req.MediaHosts) == 0 {
+		return domain.Source{}, validationError("mapping.proxy_media requires request.media_hosts")
+	}
 
 	def := in.Defaults
 	if def.MaxLimit == 0 {
@@ -86,41 +476,167 @@ func (s *devSourceService) CreateSource(ctx context.Context, in CreateSourceInpu
 		def.TimeoutMS = 5000
 	}
 
+	if def.RateLimit != nil {
+		rl := *def.RateLimit
+		def.RateLimit = &rl
+		if rl.RequestsPerSecond <= 0 {
+			return domain.Source{}, validationError("defaults.rate_limit.rps must be greater than 0")
+		}
+		switch rl.Mode {
+		case "":
+			rl.Mode = domain.RateLimitWait
+		case domain.RateLimitWait, domain.RateLimitReject:
+		default:
+			return domain.Source{}, validationError("defaults.rate_limit.mode must be 'wait' or 'reject'")
+		}
+	}
+	if r := def.Retry; r != nil {
+		if r.MaxAttempts < 0 || r.BaseDelayMS < 0 || r.MaxDelayMS < 0 {
+			return domain.Source{}, validationError("defaults.retry.max_attempts, base_delay_ms and max_delay_ms must not be negative")
+		}
+		if r.MaxDelayMS > 0 && r.BaseDelayMS > r.MaxDelayMS {
+			return domain.Source{}, validationError("defaults.retry.base_delay_ms must not exceed max_delay_ms")
+		}
+	}
+	if b := def.Breaker; b != nil && (b.FailureThreshold < 0 || b.OpenMS < 0) {
+		return domain.Source{}, validationError("defaults.breaker.failure_threshold and open_ms must not be negative")
+	}
+
+	var auth *domain.SourceAuth
+	if in.Auth != nil {
+		a := *in.Auth
+		if err := validateAuth(&a); err != nil {
+			return domain.Source{}, err
+		}
+		auth = &a
+	}
+
+	var caps *domain.SourceCapabilities
+	if in.Capabilities != nil {
+		c := *in.Capabilities
+		if !query.KnownDialect(c.Dialect) {
+			return domain.Source{}, validationError("capabilities.dialect must be one of danbooru, gelbooru, moebooru, e621")
+		}
+		if c.MaxTags < 0 || c.MaxPage < 0 {
+			return domain.Source{}, validationError("capabilities.max_tags and capabilities.max_page must not be negative")
+		}
+		if c.PageBase != nil && *c.PageBase != 0 && *c.PageBase != 1 {
+			return domain.Source{}, validationError("capabilities.page_base must be 0 or 1")
+		}
+		caps = &c
+	}
+
 	enabled := true
 	if in.Enabled != nil {
 		enabled = *in.Enabled
 	}
 
-	src := domain.Source{
-		Code:     domain.SourceCode(code),
-		Name:     name,
-		BaseURL:  strings.TrimRight(base, "/"),
-		Enabled:  enabled,
-		Request:  req,
-		Mapping:  in.Mapping,
-		Defaults: def,
+	return domain.Source{
+		Code:         domain.SourceCode(code),
+		Name:         name,
+		BaseURL:      strings.TrimRight(base, "/"),
+		Enabled:      enabled,
+		Request:      req,
+		Mapping:      mapping,
+		Defaults:     def,
+		Auth:         auth,
+		Capabilities: caps,
+	}, nil
+}
+
+func validateAuth(a *domain.SourceAuth) error {
+	switch a.Scheme {
+	case domain.AuthBasic:
+		if a.Username == "" || a.Password == "" {
+			return validationError("auth: basic requires username and password")
+		}
+	case domain.AuthQuery:
+		if a.KeyParam == "" || a.Token == "" {
+			return validationError("auth: query requires key_param and token")
+		}
+		if (a.UserParam == "") != (a.Username == "") {
+			return validationError("auth: query needs both user_param and username, or neither")
+		}
+	case domain.AuthBearer:
+		if a.Token == "" {
+			return validationError("auth: bearer requires token")
+		}
+	case domain.AuthHeader:
+		if a.HeaderName == "" || a.Token == "" {
+			return validationError("auth: header requires header_name and token")
+		}
+	default:
+		return validationError("auth.scheme must be one of basic, query, bearer, header")
+	}
+	if a.Password == domain.RedactedValue || a.Token == domain.RedactedValue {
+		return validationError("auth: secrets must be provided in clear text")
 	}
+	return nil
+}
 
-	out, err := s.repo.Create(ctx, src)
+// keepRedactedSecrets puts stored secrets back wherever a client echoed the
+// redaction placeholder from a previous GET.
+func keepRedactedSecrets(next *patchableSource, current domain.Source) {
+	if next.Auth != nil && current.Auth != nil {
+		if next.Auth.Password == domain.RedactedValue {
+			next.Auth.Password = current.Auth.Password
+		}
+		if next.Auth.Token == domain.RedactedValue {
+			next.Auth.Token = current.Auth.Token
+		}
+	}
+
+	keepRedactedHeaders(next.Request.Headers, current.Request.Headers)
+	keepRedactedHeaders(next.Request.MediaHeaders, current.Request.MediaHeaders)
+}
+
+func keepRedactedHeaders(next, current map[string]string) {
+	for k, v := range next {
+		if v != domain.RedactedValue {
+			continue
+		}
+		if orig, ok := current[k]; ok {
+			next[k] = orig
+		} else {
+			delete(next, k)
+		}
+	}
+}
+
+// sameVersion compares updated_at values at the precision Postgres stores.
+func sameVersion(a, b time.Time) bool {
+	return a.UnixMicro() == b.UnixMicro()
+}
+
+func toJSONValue(v any) (any, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		return domain.Source{}, err
+		return nil, err
+	}
+	var out any
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
 	}
 	return out, nil
 }
 
-func (s *devSourceService) GetSourceByCode(ctx context.Context, code string) (domain.Source, error) {
-	code = strings.TrimSpace(code)
-	if code == "" {
-		return domain.Source{}, errors.New("code is required")
+// mergePatch applies an RFC 7386 JSON merge patch to target.
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
 	}
 
-	src, err := s.repo.GetByCode(ctx, domain.SourceCode(code))
-	if err != nil {
-		if errors.Is(err, repository.ErrNotFound) {
-			return domain.Source{}, ErrSourceNotFound
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+			continue
 		}
-		return domain.Source{}, err
+		targetObj[k] = mergePatch(targetObj[k], v)
 	}
-
-	return src, nil
+	return targetObj
 }
@@ -0,0 +1,592 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+func mapRawToImage(src domain.Source, raw map[string]any) (domain.Image, error) {
+	m := src.Mapping.Fields
+	r := fieldResolver{src: src, raw: raw}
+
+	// Required fields
+	idMapping, ok := m["id"]
+	if !ok || !fieldMapped(idMapping) {
+		return domain.Image{}, errors.New("mapping for 'id' is missing")
+	}
+	fileMapping, ok := m["file_url"]
+	if !ok || !fieldMapped(fileMapping) {
+		return domain.Image{}, errors.New("mapping for 'file_url' is missing")
+	}
+
+	// id
+	id, ok := r.str("id")
+	if !ok || (idMapping.Key == "" && id == "") {
+		return domain.Image{}, missingFieldError("id", idMapping)
+	}
+
+	// file_url
+	fileURL, ok := r.str("file_url")
+	if !ok || (fileMapping.Key == "" && fileURL == "") {
+		return domain.Image{}, missingFieldError("file_url", fileMapping)
+	}
+
+	// Optional fields
+
+	// created_at
+	var createdAt time.Time
+	if v, ok := r.scalar("created_at"); ok {
+		if t, err := parseTimeFlexible(v, m["created_at"].Format); err == nil {
+			createdAt = t
+		}
+	}
+
+	// image_src_url
+	var source *string
+	if s, ok := r.str("source"); ok && s != "" {
+		tmp := s
+		source = &tmp
+	}
+
+	var warnings []string
+
+	// rating (string → domain.Rating)
+	var rating domain.Rating
+	if fm, ok := m["rating"]; ok && fm.Key != "" {
+		value, _ := r.str("rating")
+		resolved, known := resolveRating(src.Mapping, value)
+		if !known {
+			warnings = append(warnings, unresolvedRatingWarning(value, resolved))
+		}
+		rating = resolved
+	}
+
+	// has_children (bool / "true"/"1")
+	hasChildren := false
+	if v, ok := r.scalar("has_children"); ok {
+		hasChildren = toBoolFlexible(v)
+	}
+
+	// parent_id
+	var parentID *string
+	if s, ok := r.str("parent_id"); ok && s != "" {
+		tmp := s
+		parentID = &tmp
+	}
+
+	// md5
+	var md5 string
+	if s, ok := r.str("md5"); ok {
+		md5 = s
+	}
+
+	// score
+	var score *int
+	if v, ok := r.scalar("score"); ok {
+		if n, ok := toIntFlexible(v); ok {
+			score = &n
+		}
+	}
+
+	// tags: wildcard paths may merge several tag lists, so drop repeats.
+	var tags []string
+	if values, ok := r.strs("tags"); ok {
+		seen := make(map[string]struct{}, len(values))
+		for _, tag := range values {
+			if _, dup := seen[tag]; dup {
+				continue
+			}
+			seen[tag] = struct{}{}
+			tags = append(tags, tag)
+		}
+	}
+
+	// preview_url
+	var preview string
+	if s, ok := r.str("preview_url"); ok {
+		preview = s
+	}
+
+	// sample_url
+	var sample string
+	if s, ok := r.str("sample_url"); ok {
+		sample = s
+	}
+
+	return domain.Image{
+		ID:          id,
+		Upstream:    src.Code,
+		CreatedAt:   createdAt,
+		Source:      source,
+		Rating:      rating,
+		Tags:        tags,
+		HasChildren: hasChildren,
+		ParentID:    parentID,
+		MD5:         md5,
+		Score:       score,
+		PreviewURL:  preview,
+		SampleURL:   sample,
+		FileURL:     fileURL,
+		Warnings:    warnings,
+	}, nil
+}
+
+// defaultRatings is used for sources that do not configure their own map.
+var defaultRatings = map[string]domain.Rating{
+	"e":            domain.RatingExplicit,
+	"explicit":     domain.RatingExplicit,
+	"q":            domain.RatingQuestionable,
+	"questionable": domain.RatingQuestionable,
+	"s":            domain.RatingSensitive,
+	"sensitive":    domain.RatingSensitive,
+	"g":            domain.RatingGeneral,
+	"general":      domain.RatingGeneral,
+	"safe":         domain.RatingGeneral,
+}
+
+// resolveRating converts an upstream rating value. The bool is false when the
+// value was missing or unknown, in which case the source's fallback is returned.
+func resolveRating(mapping domain.SourceMapping, value string) (domain.Rating, bool) {
+	ratings := mapping.Ratings
+	if len(ratings) == 0 {
+		ratings = defaultRatings
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value != "" {
+		if rating, ok := ratings[value]; ok {
+			return rating, true
+		}
+	}
+	return mapping.RatingFallback, false
+}
+
+func unresolvedRatingWarning(value string, fallback domain.Rating) string {
+	what := "rating missing"
+	if value != "" {
+		what = fmt.Sprintf("rating %q not recognised", value)
+	}
+	if fallback == "" {
+		return what + ", left unrated"
+	}
+	return fmt.Sprintf("%s, using fallback %q", what, fallback)
+}
+
+// fieldMapped reports whether fm can produce a value: it has a key to read,
+// or a template to build the value from.
+func fieldMapped(fm domain.FieldMapping) bool {
+	if fm.Key != "" {
+		return true
+	}
+	for _, t := range fm.Transforms {
+		if t.Op == domain.TransformTemplate {
+			return true
+		}
+	}
+	return false
+}
+
+// missingFieldError explains why a required field has no value. Template
+// fields come out empty when a placeholder is missing from the record.
+func missingFieldError(field string, fm domain.FieldMapping) error {
+	if fm.Key == "" {
+		return fmt.Errorf("%s template has a placeholder not found in upstream json", field)
+	}
+	return fmt.Errorf("%s key %q not found in upstream json", field, fm.Key)
+}
+
+// fieldResolver reads mapped fields out of one upstream record, applying
+// each field's split and transform pipeline.
+type fieldResolver struct {
+	src domain.Source
+	raw map[string]any
+}
+
+// strs returns every value of a field as strings: the raw value (or each
+// element of a list) is stringified, split on FieldMapping.Split, run
+// through the transforms, and empty results are dropped. The bool reports
+// whether the field's key was present in the record at all.
+func (r fieldResolver) strs(field string) ([]string, bool) {
+	fm, ok := r.src.Mapping.Fields[field]
+	if !ok || (fm.Key == "" && len(fm.Transforms) == 0) {
+		return nil, false
+	}
+
+	var values []string
+	split := fm.Split
+	if fm.Key == "" {
+		// Pure template fields, e.g. {base_url}/posts/{id}.
+		values = []string{""}
+	} else {
+		v, ok := lookupPath(r.raw, fm.Key)
+		if !ok || v == nil {
+			return nil, false
+		}
+		values = stringifyValues(v)
+
+		// Tag strings default to whitespace separation; tag arrays are
+		// taken as-is since some boorus allow spaces inside tags.
+		if _, isStr := v.(string); isStr && split == "" && field == "tags" {
+			split = " "
+		}
+	}
+
+	if split != "" {
+		values = splitValues(values, split)
+	}
+
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, t := range fm.Transforms {
+			v = r.applyTransform(t, v)
+		}
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out, true
+}
+
+// str returns the first value of a field.
+func (r fieldResolver) str(field string) (string, bool) {
+	values, ok := r.strs(field)
+	if !ok {
+		return "", false
+	}
+	if len(values) == 0 {
+		return "", true
+	}
+	return values[0], true
+}
+
+// scalar returns a field value for typed parsing (times, booleans). Without
+// split/transforms the raw upstream value is kept so numbers and booleans
+// keep their type; otherwise the transformed string is returned.
+func (r fieldResolver) scalar(field string) (any, bool) {
+	fm, ok := r.src.Mapping.Fields[field]
+	if !ok {
+		return nil, false
+	}
+	if fm.Split == "" && len(fm.Transforms) == 0 {
+		if fm.Key == "" {
+			return nil, false
+		}
+		v, ok := lookupPath(r.raw, fm.Key)
+		if list, isList := v.([]any); ok && isList {
+			if len(list) == 0 {
+				return nil, false
+			}
+			v = list[0]
+		}
+		return v, ok && v != nil
+	}
+	return r.str(field)
+}
+
+func (r fieldResolver) applyTransform(t domain.FieldTransform, v string) string {
+	switch t.Op {
+	case domain.TransformTrim:
+		if t.Value != "" {
+			return strings.Trim(v, t.Value)
+		}
+		return strings.TrimSpace(v)
+	case domain.TransformLowercase:
+		return strings.ToLower(v)
+	case domain.TransformUppercase:
+		return strings.ToUpper(v)
+	case domain.TransformRegexReplace:
+		re, err := compileTransformRegex(t.Pattern)
+		if err != nil {
+			return v
+		}
+		return re.ReplaceAllString(v, t.Replace)
+	case domain.TransformPrefix:
+		if v == "" {
+			return v
+		}
+		return t.Value + v
+	case domain.TransformSuffix:
+		if v == "" {
+			return v
+		}
+		return v + t.Value
+	case domain.TransformTemplate:
+		return r.expandTemplate(t.Value, v)
+	case domain.TransformMap:
+		if mapped, ok := t.Map[v]; ok {
+			return mapped
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// expandTemplate fills {value}, {base_url}, {source} and {<path>} placeholders,
+// where <path> is looked up in the upstream record. An unresolved placeholder
+// makes the whole value empty so half-built URLs never leak out.
+func (r fieldResolver) expandTemplate(tmpl, value string) string {
+	missing := false
+	out := templatePlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		switch name {
+		case "value":
+			return value
+		case "base_url":
+			return strings.TrimRight(r.src.BaseURL, "/")
+		case "source":
+			return string(r.src.Code)
+		}
+
+		v, ok := lookupPath(r.raw, name)
+		if !ok || v == nil {
+			missing = true
+			return ""
+		}
+		values := stringifyValues(v)
+		if len(values) == 0 {
+			missing = true
+			return ""
+		}
+		return values[0]
+	})
+	if missing {
+		return ""
+	}
+	return out
+}
+
+var transformRegexCache sync.Map // pattern → *regexp.Regexp
+
+func compileTransformRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := transformRegexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	transformRegexCache.Store(pattern, re)
+	return re, nil
+}
+
+// validateFieldMapping checks the key path and transform pipeline of a field.
+func validateFieldMapping(fm domain.FieldMapping) error {
+	if fm.Key != "" {
+		if _, err := parseFieldPath(fm.Key); err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+	}
+	if !validTimeFormat(fm.Format) {
+		return fmt.Errorf("format: %q is neither unix, unix_ms, rfc3339 nor a Go time layout", fm.Format)
+	}
+
+	for i, t := range fm.Transforms {
+		switch t.Op {
+		case domain.TransformTrim, domain.TransformLowercase, domain.TransformUppercase,
+			domain.TransformPrefix, domain.TransformSuffix:
+		case domain.TransformRegexReplace:
+			if _, err := compileTransformRegex(t.Pattern); err != nil {
+				return fmt.Errorf("transforms[%d]: invalid pattern: %w", i, err)
+			}
+		case domain.TransformTemplate:
+			if t.Value == "" {
+				return fmt.Errorf("transforms[%d]: template requires a value", i)
+			}
+		case domain.TransformMap:
+			if len(t.Map) == 0 {
+				return fmt.Errorf("transforms[%d]: map requires entries", i)
+			}
+		default:
+			return fmt.Errorf("transforms[%d]: unknown op %q", i, t.Op)
+		}
+	}
+
+	return nil
+}
+
+// stringifyValues renders a decoded value (or each element of a list) as strings.
+func stringifyValues(v any) []string {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, item := range t {
+			out = append(out, stringifyValues(item)...)
+		}
+		return out
+	case string:
+		return []string{t}
+	case json.Number:
+		// JSON number in string form, e.g. "10317194"
+		return []string{t.String()}
+	case float64:
+		// Just in case some responses still use float64
+		return []string{strconv.FormatFloat(t, 'f', -1, 64)}
+	default:
+		return []string{fmt.Sprint(t)}
+	}
+}
+
+func splitValues(values []string, sep string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		var parts []string
+		if strings.TrimSpace(sep) == "" {
+			parts = strings.Fields(v)
+		} else {
+			parts = strings.Split(v, sep)
+		}
+		for _, p := range parts {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// autoTimeLayouts are tried in order when a field has no explicit format.
+var autoTimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RubyDate, // Gelbooru: "Sat Oct 01 12:34:56 -0500 2023"
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// parseTimeFlexible parses a timestamp according to FieldMapping.Format:
+// "unix", "unix_ms", "rfc3339" or any Go layout. With no format it tries
+// the usual layouts and treats numbers as unix seconds, or milliseconds
+// when they are too large to be seconds.
+func parseTimeFlexible(v any, format string) (time.Time, error) {
+	switch format {
+	case "":
+	case domain.TimeFormatUnix, domain.TimeFormatUnixMS:
+		n, ok := toFloatFlexible(v)
+		if !ok {
+			return time.Time{}, fmt.Errorf("expected a number for %s time, got %T", format, v)
+		}
+		if format == domain.TimeFormatUnixMS {
+			return time.UnixMilli(int64(n)).UTC(), nil
+		}
+		return unixFloat(n), nil
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("expected a string for time format %q, got %T", format, v)
+		}
+		layout := format
+		if format == domain.TimeFormatRFC3339 {
+			layout = time.RFC3339Nano
+		}
+		return time.Parse(layout, strings.TrimSpace(s))
+	}
+
+	switch t := v.(type) {
+	case string:
+		t = strings.TrimSpace(t)
+		if t == "" {
+			return time.Time{}, fmt.Errorf("empty time string")
+		}
+		for _, layout := range autoTimeLayouts {
+			if ts, err := time.Parse(layout, t); err == nil {
+				return ts, nil
+			}
+		}
+		// try unix format
+		if n, err := strconv.ParseFloat(t, 64); err == nil {
+			return unixAuto(n), nil
+		}
+		return time.Time{}, fmt.Errorf("unsupported time string %q", t)
+	case json.Number, float64, int64, int:
+		n, _ := toFloatFlexible(t)
+		return unixAuto(n), nil
+	default:
+		return time.Time{}, fmt.Errorf("unsupported time type %T", v)
+	}
+}
+
+// unixAuto guesses between unix seconds and milliseconds: second values
+// above 1e11 would be past the year 5000.
+func unixAuto(n float64) time.Time {
+	if n > 1e11 || n < -1e11 {
+		return time.UnixMilli(int64(n)).UTC()
+	}
+	return unixFloat(n)
+}
+
+func unixFloat(n float64) time.Time {
+	sec := int64(n)
+	nsec := int64((n - float64(sec)) * 1e9)
+	return time.Unix(sec, nsec).UTC()
+}
+
+// validTimeFormat reports whether format is a named format or a usable Go layout.
+func validTimeFormat(format string) bool {
+	switch format {
+	case "", domain.TimeFormatUnix, domain.TimeFormatUnixMS, domain.TimeFormatRFC3339:
+		return true
+	}
+	ref := time.Date(2023, 10, 1, 12, 34, 56, 0, time.UTC)
+	formatted := ref.Format(format)
+	if formatted == format {
+		// No layout elements at all.
+		return false
+	}
+	_, err := time.Parse(format, formatted)
+	return err == nil
+}
+
+func toFloatFlexible(v any) (float64, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	case float64:
+		return t, true
+	case int64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	default:
+		return 0, false
+	}
+}
+
+func toBoolFlexible(v any) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		s := strings.ToLower(strings.TrimSpace(t))
+		return s == "true" || s == "1" || s == "yes"
+	case json.Number:
+		f, err := t.Float64()
+		return err == nil && f != 0
+	case float64:
+		return t != 0
+	case int:
+		return t != 0
+	case int64:
+		return t != 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A field path addresses a value inside a decoded upstream record:
+//
+//	file_url          top-level key
+//	file.url          nested object key
+//	tags.general[0]   array index
+//	tags.general[]    every element of an array ("[*]" works too)
+//	tags.*            every value of an object, in key order
+//
+// Paths containing a wildcard resolve to a flattened []any, so e.g. e621's
+// per-category tag lists can be merged with "tags.*".
+
+type pathSegmentKind int
+
+const (
+	segKey pathSegmentKind = iota
+	segIndex
+	segWildcard
+)
+
+type pathSegment struct {
+	kind  pathSegmentKind
+	key   string
+	index int
+}
+
+type fieldPath struct {
+	raw      string
+	segments []pathSegment
+	wildcard bool
+}
+
+func parseFieldPath(path string) (fieldPath, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return fieldPath{}, fmt.Errorf("empty path")
+	}
+
+	fp := fieldPath{raw: path}
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		var brackets string
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name, brackets = part[:i], part[i:]
+		}
+
+		switch {
+		case name == "*":
+			fp.segments = append(fp.segments, pathSegment{kind: segWildcard})
+			fp.wildcard = true
+		case name != "":
+			fp.segments = append(fp.segments, pathSegment{kind: segKey, key: name})
+		case brackets == "":
+			return fieldPath{}, fmt.Errorf("path %q has an empty segment", path)
+		}
+
+		for brackets != "" {
+			end := strings.IndexByte(brackets, ']')
+			if brackets[0] != '[' || end < 0 {
+				return fieldPath{}, fmt.Errorf("path %q has an unterminated index", path)
+			}
+			inner := strings.TrimSpace(brackets[1:end])
+			brackets = brackets[end+1:]
+
+			if inner == "" || inner == "*" {
+				fp.segments = append(fp.segments, pathSegment{kind: segWildcard})
+				fp.wildcard = true
+				continue
+			}
+			idx, err := strconv.Atoi(inner)
+			if err != nil || idx < 0 {
+				return fieldPath{}, fmt.Errorf("path %q has an invalid index %q", path, inner)
+			}
+			fp.segments = append(fp.segments, pathSegment{kind: segIndex, index: idx})
+		}
+	}
+
+	return fp, nil
+}
+
+// lookupPath resolves path against a decoded record. A top-level key that
+// matches the whole path verbatim wins, so keys that themselves contain dots
+// or brackets keep working.
+func lookupPath(record map[string]any, path string) (any, bool) {
+	if v, ok := record[path]; ok {
+		return v, true
+	}
+
+	fp, err := parseFieldPath(path)
+	if err != nil {
+		return nil, false
+	}
+	return fp.resolve(record)
+}
+
+func (fp fieldPath) resolve(root any) (any, bool) {
+	values := []any{root}
+	for _, seg := range fp.segments {
+		next := make([]any, 0, len(values))
+		for _, v := range values {
+			next = append(next, seg.apply(v)...)
+		}
+		if len(next) == 0 {
+			return nil, false
+		}
+		values = next
+	}
+
+	if !fp.wildcard {
+		return values[0], true
+	}
+	return flattenValues(values), true
+}
+
+func (seg pathSegment) apply(v any) []any {
+	switch seg.kind {
+	case segKey:
+		if obj, ok := v.(map[string]any); ok {
+			if child, ok := obj[seg.key]; ok {
+				return []any{child}
+			}
+		}
+	case segIndex:
+		if arr, ok := v.([]any); ok && seg.index < len(arr) {
+			return []any{arr[seg.index]}
+		}
+	case segWildcard:
+		switch t := v.(type) {
+		case []any:
+			return t
+		case map[string]any:
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			out := make([]any, 0, len(keys))
+			for _, k := range keys {
+				out = append(out, t[k])
+			}
+			return out
+		}
+	}
+	return nil
+}
+
+// flattenValues expands nested arrays and drops nulls.
+func flattenValues(values []any) []any {
+	out := make([]any, 0, len(values))
+	for _, v := range values {
+		switch t := v.(type) {
+		case nil:
+		case []any:
+			out = append(out, flattenValues(t)...)
+		default:
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// MappingDiagnostics explains what happened to the posts of one upstream
+// response: how many were mapped and why the others were dropped.
+type MappingDiagnostics struct {
+	Received int            `json:"received"`
+	Mapped   int            `json:"mapped"`
+	Dropped  int            `json:"dropped"`
+	Reasons  map[string]int `json:"reasons,omitempty"`
+}
+
+func (d *MappingDiagnostics) recordDrop(err error) {
+	d.Dropped++
+	if d.Reasons == nil {
+		d.Reasons = map[string]int{}
+	}
+	d.Reasons[err.Error()]++
+}
+
+// MappingStats are the cumulative mapping counters of a source since the
+// process started. A rising Dropped count usually means the upstream
+// schema changed under the source's mapping.
+type MappingStats struct {
+	Source     domain.SourceCode `json:"source"`
+	Received   int64             `json:"received"`
+	Mapped     int64             `json:"mapped"`
+	Dropped    int64             `json:"dropped"`
+	Reasons    map[string]int64  `json:"reasons,omitempty"`
+	LastDropAt *time.Time        `json:"last_drop_at,omitempty"`
+}
+
+type mappingStatsRegistry struct {
+	mu    sync.Mutex
+	stats map[domain.SourceCode]*MappingStats
+}
+
+func newMappingStatsRegistry() *mappingStatsRegistry {
+	return &mappingStatsRegistry{stats: map[domain.SourceCode]*MappingStats{}}
+}
+
+func (r *mappingStatsRegistry) record(code domain.SourceCode, d MappingDiagnostics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st, ok := r.stats[code]
+	if !ok {
+		st = &MappingStats{Source: code}
+		r.stats[code] = st
+	}
+	st.Received += int64(d.Received)
+	st.Mapped += int64(d.Mapped)
+	st.Dropped += int64(d.Dropped)
+	if d.Dropped > 0 {
+		now := time.Now().UTC()
+		st.LastDropAt = &now
+		if st.Reasons == nil {
+			st.Reasons = map[string]int64{}
+		}
+		for reason, n := range d.Reasons {
+			st.Reasons[reason] += int64(n)
+		}
+	}
+}
+
+// snapshot returns a copy of the counters, ordered by source code.
+func (r *mappingStatsRegistry) snapshot() []MappingStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]MappingStats, 0, len(r.stats))
+	for _, st := range r.stats {
+		cp := *st
+		if st.Reasons != nil {
+			cp.Reasons = make(map[string]int64, len(st.Reasons))
+			for k, v := range st.Reasons {
+				cp.Reasons[k] = v
+			}
+		}
+		if st.LastDropAt != nil {
+			t := *st.LastDropAt
+			cp.LastDropAt = &t
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+	return out
+}
@@ -0,0 +1,342 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+	"github.com/freikugel0/boorumesh-be/internal/media"
+	"github.com/freikugel0/boorumesh-be/internal/repository"
+)
+
+var (
+	ErrMediaDisabled       = errors.New("media proxy is not enabled for this source")
+	ErrMediaHostNotAllowed = errors.New("media host is not allowed for this source")
+	ErrMediaTooLarge       = errors.New("media exceeds the source's size limit")
+	ErrMediaType           = errors.New("upstream content is not an image or video")
+	ErrMediaCacheDisabled  = errors.New("media cache is not configured")
+)
+
+const defaultMediaMaxBytes = 64 << 20
+
+// mediaForwardHeaders are client request headers passed on upstream so
+// ranges and revalidation work end to end.
+var mediaForwardHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+// mediaRelayHeaders are upstream response headers passed back to clients.
+var mediaRelayHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges",
+	"ETag", "Last-Modified", "Cache-Control", "Expires",
+}
+
+type MediaService interface {
+	// Open serves req from the disk cache or starts fetching it upstream.
+	// The caller must close the returned body.
+	Open(ctx context.Context, req media.ProxyRequest, header http.Header) (*MediaStream, error)
+	// Thumbnail serves req.Target scaled down to req.Width.
+	Thumbnail(ctx context.Context, req media.ThumbRequest) (*MediaStream, error)
+
+	CacheUsage() (media.CacheUsage, error)
+	// PurgeCache empties the cache for one source, or entirely when code
+	// is empty.
+	PurgeCache(code string) (media.SourceUsage, error)
+}
+
+// MediaStream is a media response ready to be relayed. Cache hits set
+// Cached, which is also the Body.
+type MediaStream struct {
+	StatusCode int
+	Header     http.Header
+	Body       io.ReadCloser
+	Cached     *media.CachedFile
+}
+
+type mediaService struct {
+	repo      repository.SourceRepository
+	transport http.RoundTripper
+	cache     *media.DiskCache
+	inflight  singleflight.Group
+	// decodeSlots bounds concurrent thumbnail decodes, which each hold a
+	// full decoded image in memory.
+	decodeSlots chan struct{}
+}
+
+// NewMediaService builds the media proxy service. diskCache may be nil to
+// stream every request from upstream.
+func NewMediaService(repo repository.SourceRepository, diskCache *media.DiskCache) MediaService {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return &mediaService{
+		repo:        repo,
+		transport:   transport,
+		cache:       diskCache,
+		decodeSlots: make(chan struct{}, runtime.GOMAXPROCS(0)),
+	}
+}
+
+func (s *mediaService) Open(ctx context.Context, preq media.ProxyRequest, header http.Header) (*MediaStream, error) {
+	code, target := preq.Code, preq.Target
+	src, err := s.mediaSource(ctx, code, target)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := preq.Key
+	if cacheKey == "" {
+		cacheKey = media.URLKey(target.String())
+	}
+	if out, ok := s.openCached(code, cacheKey); ok {
+		return out, nil
+	}
+
+	// Only whole-file requests fill the cache; ranges are streamed, and a
+	// 304 can't fill the cache, so conditional headers are dropped then.
+	cacheable := s.cache != nil && header.Get("Range") == ""
+	forward := make(http.Header)
+	for _, k := range mediaForwardHeaders {
+		if cacheable && k != "Range" {
+			continue
+		}
+		if v := header.Get(k); v != "" {
+			forward.Set(k, v)
+		}
+	}
+
+	out, length, err := s.fetch(ctx, src, target, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable && out.StatusCode == http.StatusOK {
+		w, err := s.cache.Create(code, cacheKey, media.CacheMeta{
+			ContentType:  out.Header.Get("Content-Type"),
+			URL:          target.String(),
+			ETag:         out.Header.Get("ETag"),
+			LastModified: out.Header.Get("Last-Modified"),
+			CacheControl: out.Header.Get("Cache-Control"),
+		})
+		if err != nil {
+			log.Printf("media cache %s: %v", code, err)
+		} else {
+			out.Body = &cachingBody{rc: out.Body, w: w, want: length}
+		}
+	}
+	return out, nil
+}
+
+// mediaSource loads the source and checks it may proxy target.
+func (s *mediaService) mediaSource(ctx context.Context, code string, target *url.URL) (domain.Source, error) {
+	src, err := s.repo.GetByCode(ctx, domain.SourceCode(code))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return domain.Source{}, ErrSourceNotFound
+		}
+		return domain.Source{}, err
+	}
+	if !src.Enabled {
+		return domain.Source{}, ErrSourceDisabled
+	}
+
+	if len(src.Request.MediaHosts) == 0 {
+		return domain.Source{}, ErrMediaDisabled
+	}
+	if !media.HostAllowed(target.Hostname(), src.Request.MediaHosts) {
+		return domain.Source{}, ErrMediaHostNotAllowed
+	}
+	return src, nil
+}
+
+func (s *mediaService) openCached(code, key string) (*MediaStream, bool) {
+	if s.cache == nil {
+		return nil, false
+	}
+	f, ok := s.cache.Open(code, key)
+	if !ok {
+		return nil, false
+	}
+	header := http.Header{"Content-Type": {f.ContentType}}
+	if f.ETag != "" {
+		header.Set("ETag", f.ETag)
+	}
+	if f.CacheControl != "" {
+		header.Set("Cache-Control", f.CacheControl)
+	}
+	return &MediaStream{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       f,
+		Cached:     f,
+	}, true
+}
+
+// fetch requests target from upstream with the source's media headers plus
+// header, and returns the response along with its announced length (-1 if
+// unknown).
+func (s *mediaService) fetch(ctx context.Context, src domain.Source, target *url.URL, header http.Header) (*MediaStream, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	// CDNs that check the User-Agent expect the source's own; media_headers
+	// can still override it.
+	if ua := src.Request.Headers["User-Agent"]; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	for k, v := range src.Request.MediaHeaders {
+		req.Header.Set(k, v)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	allowed := src.Request.MediaHosts
+	client := &http.Client{
+		Transport: s.transport,
+		// Redirects must stay on allowed hosts too, or the allowlist is moot.
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !media.HostAllowed(r.URL.Hostname(), allowed) {
+				return fmt.Errorf("%w: redirect to %s", ErrMediaHostNotAllowed, r.URL.Host)
+			}
+			return nil
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, 0, &UpstreamStatusError{StatusCode: resp.StatusCode}
+	}
+
+	maxBytes := src.Request.MediaMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMediaMaxBytes
+	}
+	if resp.ContentLength > maxBytes {
+		resp.Body.Close()
+		return nil, 0, ErrMediaTooLarge
+	}
+
+	out := &MediaStream{
+		StatusCode: resp.StatusCode,
+		Header:     make(http.Header),
+		Body:       &maxBytesBody{rc: resp.Body, remaining: maxBytes},
+	}
+	for _, k := range mediaRelayHeaders {
+		if v := resp.Header.Values(k); len(v) > 0 {
+			out.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	// Revalidation answers carry validators but no body to check.
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusNoContent {
+		return out, 0, nil
+	}
+	// Responses are served from this API's origin, so anything that could
+	// run script there (HTML, SVG, ...) must not be relayed.
+	if ct := out.Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "video/") ||
+		strings.HasPrefix(ct, "image/svg") {
+		out.Body.Close()
+		return nil, 0, ErrMediaType
+	}
+	return out, resp.ContentLength, nil
+}
+
+func (s *mediaService) CacheUsage() (media.CacheUsage, error) {
+	if s.cache == nil {
+		return media.CacheUsage{}, ErrMediaCacheDisabled
+	}
+	return s.cache.Usage(), nil
+}
+
+func (s *mediaService) PurgeCache(code string) (media.SourceUsage, error) {
+	if s.cache == nil {
+		return media.SourceUsage{}, ErrMediaCacheDisabled
+	}
+	return s.cache.Purge(strings.TrimSpace(code))
+}
+
+// cachingBody copies the stream into the cache as it is relayed. The file
+// is only committed once the body was read to the end with the announced
+// length; any error or early Close discards it.
+type cachingBody struct {
+	rc   io.ReadCloser
+	w    *media.CacheWriter
+	want int64
+	got  int64
+	done bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if !b.done && n > 0 {
+		if _, werr := b.w.Write(p[:n]); werr != nil {
+			b.abort()
+		}
+		b.got += int64(n)
+	}
+	if !b.done && err != nil {
+		if err == io.EOF && (b.want < 0 || b.got == b.want) {
+			b.done = true
+			if cerr := b.w.Commit(); cerr != nil {
+				log.Printf("media cache: %v", cerr)
+			}
+		} else {
+			b.abort()
+		}
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	b.abort()
+	return b.rc.Close()
+}
+
+func (b *cachingBody) abort() {
+	if !b.done {
+		b.done = true
+		b.w.Abort()
+	}
+}
+
+// maxBytesBody fails the stream once more than remaining bytes were read,
+// for upstreams that don't announce a Content-Length.
+type maxBytesBody struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrMediaTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrMediaTooLarge
+	}
+	return n, err
+}
+
+func (b *maxBytesBody) Close() error {
+	return b.rc.Close()
+}
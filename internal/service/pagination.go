@@ -0,0 +1,128 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// pagePosition is where a request starts in the result list: a page number
+// or, for cursor-paginated sources, just before or after a post id. Page is
+// kept for id positions too so cursors can tell whether there is a previous page.
+type pagePosition struct {
+	Page   int
+	Before int64
+	After  int64
+}
+
+func (p pagePosition) byID() bool {
+	return p.Before > 0 || p.After > 0
+}
+
+// pageCursor is the payload of the opaque cursor tokens handed to clients.
+type pageCursor struct {
+	Source domain.SourceCode `json:"s"`
+	Page   int               `json:"p"`
+	Before int64             `json:"b,omitempty"`
+	After  int64             `json:"a,omitempty"`
+}
+
+func encodeCursor(code domain.SourceCode, pos pagePosition) string {
+	b, _ := json.Marshal(pageCursor{Source: code, Page: pos.Page, Before: pos.Before, After: pos.After})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads a token issued by encodeCursor for the same source.
+func decodeCursor(src domain.Source, token string) (pagePosition, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return pagePosition{}, ErrInvalidCursor
+	}
+	var c pageCursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.Page < 1 || c.Before < 0 || c.After < 0 {
+		return pagePosition{}, ErrInvalidCursor
+	}
+	if c.Source != src.Code {
+		return pagePosition{}, fmt.Errorf("%w: cursor belongs to source %s", ErrInvalidCursor, c.Source)
+	}
+
+	pos := pagePosition{Page: c.Page, Before: c.Before, After: c.After}
+	if pos.byID() && src.Request.Pagination != domain.PaginationCursor {
+		return pagePosition{}, fmt.Errorf("%w: source %s does not page by id", ErrInvalidCursor, src.Code)
+	}
+	return pos, nil
+}
+
+// pageParamValue is what goes into RequestConfig.PageParam for pos.
+func pageParamValue(src domain.Source, pos pagePosition, limit int) string {
+	switch src.Request.Pagination {
+	case domain.PaginationPID:
+		return strconv.Itoa(pos.Page - 1)
+	case domain.PaginationOffset:
+		return strconv.Itoa((pos.Page - 1) * limit)
+	case domain.PaginationCursor:
+		if pos.Before > 0 {
+			return "b" + strconv.FormatInt(pos.Before, 10)
+		}
+		if pos.After > 0 {
+			return "a" + strconv.FormatInt(pos.After, 10)
+		}
+	}
+
+	page := pos.Page
+	if src.Capabilities != nil {
+		page = page - 1 + src.Capabilities.FirstPage()
+	}
+	return strconv.Itoa(page)
+}
+
+// pageCursors returns the cursors around a fetched page. received is the
+// number of upstream records; a full page is taken to mean there are more
+// unless the upstream reported a total. byID selects id cursors, which only
+// make sense for cursor-paginated sources in their default (id) order.
+func pageCursors(src domain.Source, pos pagePosition, limit, received int, total *int, images []domain.Image, byID bool) (next, prev string) {
+	more := received >= limit
+	if total != nil && !pos.byID() {
+		more = pos.Page*limit < *total
+	}
+
+	var minID, maxID int64
+	if byID {
+		for i, img := range images {
+			id, err := strconv.ParseInt(img.ID, 10, 64)
+			if err != nil {
+				byID = false
+				break
+			}
+			if i == 0 || id < minID {
+				minID = id
+			}
+			if i == 0 || id > maxID {
+				maxID = id
+			}
+		}
+		byID = byID && len(images) > 0
+	}
+
+	if more {
+		np := pagePosition{Page: pos.Page + 1}
+		if byID {
+			np.Before = minID
+		}
+		next = encodeCursor(src.Code, np)
+	}
+	if pos.Page > 1 {
+		pp := pagePosition{Page: pos.Page - 1}
+		if byID {
+			pp.After = maxID
+		}
+		prev = encodeCursor(src.Code, pp)
+	}
+	return next, prev
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+var (
+	ErrPostNotFound          = errors.New("post not found")
+	ErrPostLookupUnsupported = errors.New("source does not support post lookup")
+	errPostIDRequired        = errors.New("post id is required")
+)
+
+// PostResult is a single mapped upstream post.
+type PostResult struct {
+	Image  domain.Image
+	Cached bool
+}
+
+func (s *sourceFetchService) FetchPost(ctx context.Context, code, id string) (PostResult, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return PostResult{}, errPostIDRequired
+	}
+
+	upstream, err := s.enabledSource(ctx, code)
+	if err != nil {
+		return PostResult{}, err
+	}
+
+	req, cfg, err := buildPostRequest(upstream, id)
+	if err != nil {
+		return PostResult{}, err
+	}
+
+	key := fmt.Sprintf("post:%s:%d:%s", upstream.Code, upstream.UpdatedAt.UnixMicro(), id)
+	body, cached, err := s.fetchBody(ctx, upstream, req, key)
+	if err != nil {
+		var statusErr *UpstreamStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return PostResult{}, ErrPostNotFound
+		}
+		return PostResult{}, err
+	}
+
+	decoded, err := decodeUpstream(cfg, body)
+	if err != nil {
+		return PostResult{}, err
+	}
+
+	posts := decoded.Posts
+	if cfg.PostIDParam != "" {
+		// Id-param lookups go through the search endpoint, which may answer
+		// with other posts (its newest, if it ignores the param), so only
+		// records with exactly this upstream id count.
+		posts = slices.DeleteFunc(posts, func(raw map[string]any) bool {
+			return !rawIDMatches(upstream, raw, id)
+		})
+	}
+
+	images, diag := mapPosts(upstream, posts)
+	s.proxyMedia(upstream, images)
+	// Cached answers were counted when they were fetched.
+	if !cached {
+		s.stats.record(upstream.Code, diag)
+	}
+	if len(images) == 0 {
+		if diag.Dropped > 0 {
+			return PostResult{}, fmt.Errorf("post %s could not be mapped: %v", id, diag.Reasons)
+		}
+		return PostResult{}, ErrPostNotFound
+	}
+	return PostResult{Image: images[0], Cached: cached}, nil
+}
+
+// rawIDMatches reports whether the upstream id of raw, before the mapping's
+// transforms, is id. Ids built purely from a template have no upstream
+// value to compare, so they always match.
+func rawIDMatches(src domain.Source, raw map[string]any, id string) bool {
+	fm := src.Mapping.Fields["id"]
+	if fm.Key == "" {
+		return true
+	}
+	v, ok := lookupPath(raw, fm.Key)
+	return ok && slices.Contains(stringifyValues(v), id)
+}
+
+// buildPostRequest turns a post lookup into the upstream URL for src, along
+// with the config to decode the answer with.
+func buildPostRequest(src domain.Source, id string) (upstreamRequest, domain.RequestConfig, error) {
+	cfg := src.Request
+	base := strings.TrimRight(src.BaseURL, "/") + "/"
+
+	var (
+		u   *url.URL
+		err error
+	)
+	switch {
+	case cfg.PostPath != "":
+		path := strings.ReplaceAll(cfg.PostPath, "{id}", url.PathEscape(id))
+		u, err = url.Parse(base + strings.TrimLeft(path, "/"))
+		if err != nil {
+			return upstreamRequest{}, cfg, fmt.Errorf("invalid upstream url: %w", err)
+		}
+		q := u.Query()
+		for k, v := range cfg.ExtraQuery {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+
+		cfg.ResponseRoot = cfg.PostRoot
+		cfg.TotalPath = ""
+	case cfg.PostIDParam != "":
+		u, err = url.Parse(base + strings.TrimLeft(cfg.PostsPath, "/"))
+		if err != nil {
+			return upstreamRequest{}, cfg, fmt.Errorf("invalid upstream url: %w", err)
+		}
+		q := u.Query()
+		for k, v := range cfg.ExtraQuery {
+			q.Set(k, v)
+		}
+		q.Set(cfg.PostIDParam, id)
+		if cfg.LimitParam != "" {
+			q.Set(cfg.LimitParam, "1")
+		}
+		u.RawQuery = q.Encode()
+	default:
+		return upstreamRequest{}, cfg, ErrPostLookupUnsupported
+	}
+
+	return upstreamRequest{
+		URL:     u.String(),
+		Headers: cfg.Headers,
+		Page:    1,
+		Limit:   1,
+	}, cfg, nil
+}
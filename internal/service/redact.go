@@ -0,0 +1,68 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// redactedURLError replaces a *url.Error whose URL may carry credentials.
+// It unwraps to the underlying cause so timeout and cancellation checks
+// keep working.
+type redactedURLError struct {
+	msg string
+	err error
+}
+
+func (e *redactedURLError) Error() string { return e.msg }
+func (e *redactedURLError) Unwrap() error { return e.err }
+
+// sanitizeError strips the query-scheme credentials of auth from a
+// transport error's URL. With no such credentials to go by, the whole query
+// is dropped. Other errors are returned as they are.
+func sanitizeError(err error, auth *domain.SourceAuth) error {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return err
+	}
+
+	var params []string
+	if auth != nil && auth.Scheme == domain.AuthQuery {
+		params = []string{auth.KeyParam, auth.UserParam}
+	}
+	return &redactedURLError{
+		msg: fmt.Sprintf("%s %q: %v", ue.Op, redactURL(ue.URL, params), ue.Err),
+		err: ue.Err,
+	}
+}
+
+// ErrorText is err's message with any upstream URL it contains redacted,
+// for showing errors to API clients.
+func ErrorText(err error) string {
+	return sanitizeError(err, nil).Error()
+}
+
+// redactURL removes params from raw's query, or the whole query when
+// params is nil.
+func redactURL(raw string, params []string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[redacted url]"
+	}
+	u.User = nil
+	if params == nil {
+		u.RawQuery = ""
+		return u.String()
+	}
+
+	q := u.Query()
+	for _, p := range params {
+		if p != "" && q.Has(p) {
+			q.Set(p, domain.RedactedValue)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -1,348 +1,380 @@
 package service
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
+	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"golang.org/x/sync/singleflight"
 
+	"github.com/freikugel0/boorumesh-be/internal/breaker"
+	"github.com/freikugel0/boorumesh-be/internal/cache"
 	"github.com/freikugel0/boorumesh-be/internal/domain"
+	"github.com/freikugel0/boorumesh-be/internal/media"
+	"github.com/freikugel0/boorumesh-be/internal/query"
+	"github.com/freikugel0/boorumesh-be/internal/ratelimit"
 	"github.com/freikugel0/boorumesh-be/internal/repository"
 )
 
 var (
 	ErrSourceDisabled = errors.New("source is disabled")
+	// ErrSourceAuthUnavailable is returned for sources whose stored auth
+	// could not be decrypted.
+	ErrSourceAuthUnavailable = errors.New("source credentials could not be decrypted")
+	ErrRateLimited           = errors.New("source rate limit exceeded")
+	ErrCircuitOpen           = errors.New("source circuit breaker is open")
+	ErrInvalidQuery          = errors.New("invalid query")
+	// ErrUnsupportedQuery is returned when a query or page breaks the
+	// source's declared capabilities.
+	ErrUnsupportedQuery = errors.New("query not supported by source")
 )
 
 type SourceFetchService interface {
-	FetchBySource(ctx context.Context, code string, tags []string, page, limit int, raw bool) ([]domain.Image, error)
+	FetchBySource(ctx context.Context, code string, in FetchInput) (FetchResult, error)
+	Search(ctx context.Context, in FetchInput) (SearchResult, error)
+	FetchPost(ctx context.Context, code, id string) (PostResult, error)
+	MappingStats() []MappingStats
+	Probe(ctx context.Context, src domain.Source, in ProbeInput) (ProbeResult, error)
+	BreakerStates() []breaker.Snapshot
+}
+
+// FetchInput is a search against one or all sources. Raw skips the source's
+// tags suffix. Cursor, a token from a previous FetchResult, replaces Page
+// and only works for single-source fetches.
+type FetchInput struct {
+	Tags   []string
+	Page   int
+	Limit  int
+	Raw    bool
+	Cursor string
+	// Prefer overrides source priorities when deduplicating merged results;
+	// earlier sources win. KeepDuplicates turns deduplication off.
+	Prefer         []domain.SourceCode
+	KeepDuplicates bool
+}
+
+// FetchResult is the mapped output of a single upstream call. Total is only
+// set when the upstream envelope reports it (see RequestConfig.TotalPath).
+// NextCursor is empty when there seem to be no more results, PrevCursor on
+// the first page.
+type FetchResult struct {
+	Images     []domain.Image
+	Total      *int
+	Mapping    MappingDiagnostics
+	Query      QueryDiagnostics
+	Cached     bool
+	NextCursor string
+	PrevCursor string
+	// Page and Limit are what was actually fetched, after cursors and the
+	// source's MaxLimit were applied. URL is the upstream URL, which never
+	// carries auth secrets.
+	Page  int
+	Limit int
+	URL   string
+}
+
+// QueryDiagnostics shows how the unified query was split between the
+// upstream and the post-filter.
+type QueryDiagnostics struct {
+	Upstream   string   `json:"upstream"`
+	PostFilter []string `json:"post_filter,omitempty"`
+	// Filtered counts mapped images removed by the post-filter.
+	Filtered int `json:"filtered"`
+}
+
+// SourceStatus reports how a single source fared during a fan-out search.
+type SourceStatus struct {
+	Source domain.SourceCode `json:"source"`
+	OK     bool              `json:"ok"`
+	Count  int               `json:"count"`
+	Total  *int              `json:"total,omitempty"`
+	// Mapping and Query are only filled in for debug requests.
+	Mapping *MappingDiagnostics `json:"mapping,omitempty"`
+	Query   *QueryDiagnostics   `json:"query,omitempty"`
+	Error   string              `json:"error,omitempty"`
+	TookMS  int64               `json:"took_ms"`
+}
+
+// SearchResult is the merged output of a fan-out search across all enabled
+// sources. Duplicates counts images folded into another's AlsoOn.
+type SearchResult struct {
+	Images     []domain.Image `json:"images"`
+	Sources    []SourceStatus `json:"sources"`
+	Duplicates int            `json:"duplicates"`
 }
 
 type sourceFetchService struct {
 	repo       repository.SourceRepository
 	httpClient *resty.Client
+	stats      *mappingStatsRegistry
+	cache      cache.Cache
+	inflight   singleflight.Group
+	limiters   *ratelimit.Registry
+	breakers   *breaker.Registry
+	media      *media.URLBuilder
 }
 
-func NewSourceFetchService(repo repository.SourceRepository) SourceFetchService {
-	client := resty.New().SetTimeout(10 * time.Second)
+// clientTimeout bounds upstream calls of sources without a timeout_ms.
+const clientTimeout = 10 * time.Second
+
+// NewSourceFetchService builds the fetch service. respCache may be nil to
+// disable response caching; identical concurrent requests are coalesced
+// either way. mediaURLs rewrites image URLs for sources with proxy_media set.
+func NewSourceFetchService(repo repository.SourceRepository, respCache cache.Cache, mediaURLs *media.URLBuilder) SourceFetchService {
+	client := resty.New().SetTimeout(clientTimeout)
 
 	return &sourceFetchService{
 		repo:       repo,
 		httpClient: client,
+		stats:      newMappingStatsRegistry(),
+		cache:      respCache,
+		limiters:   ratelimit.NewRegistry(),
+		breakers:   breaker.NewRegistry(),
+		media:      mediaURLs,
 	}
 }
 
-func (s *sourceFetchService) FetchBySource(ctx context.Context, code string, tags []string, page, limit int, raw bool) ([]domain.Image, error) {
+func (s *sourceFetchService) FetchBySource(ctx context.Context, code string, in FetchInput) (FetchResult, error) {
+	upstream, err := s.enabledSource(ctx, code)
+	if err != nil {
+		return FetchResult{}, err
+	}
+
+	pos := pagePosition{Page: in.Page}
+	if in.Cursor != "" {
+		if pos, err = decodeCursor(upstream, in.Cursor); err != nil {
+			return FetchResult{}, err
+		}
+	}
+
+	return s.fetchFromSource(ctx, upstream, in.Tags, pos, in.Limit, in.Raw)
+}
+
+// enabledSource loads the source a public request is addressed to.
+func (s *sourceFetchService) enabledSource(ctx context.Context, code string) (domain.Source, error) {
 	code = strings.TrimSpace(code)
 	if code == "" {
-		return nil, errors.New("code is required")
+		return domain.Source{}, errors.New("code is required")
 	}
 
 	// Get upstream source
 	upstream, err := s.repo.GetByCode(ctx, domain.SourceCode(code))
 	if err != nil {
 		if errors.Is(err, repository.ErrNotFound) {
-			return nil, ErrSourceNotFound
+			return domain.Source{}, ErrSourceNotFound
 		}
-		return nil, err
+		return domain.Source{}, err
 	}
 	if !upstream.Enabled {
-		return nil, ErrSourceDisabled
-	}
-
-	// Apply default limit / page
-	if page <= 0 {
-		page = 1
+		return domain.Source{}, ErrSourceDisabled
 	}
-	maxLimit := upstream.Defaults.MaxLimit
-	if maxLimit <= 0 {
-		maxLimit = 100
+	if upstream.AuthError != "" {
+		return domain.Source{}, ErrSourceAuthUnavailable
 	}
-	if limit <= 0 || limit > maxLimit {
-		limit = maxLimit
-	}
-
-	// Build base URL: base_url + posts_path
-	baseURL := strings.TrimRight(upstream.BaseURL, "/") + "/" + strings.TrimLeft(upstream.Request.PostsPath, "/")
-
-	// Context with timeout per-source
-	if upstream.Defaults.TimeoutMS > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(upstream.Defaults.TimeoutMS)*time.Millisecond)
-		defer cancel()
-	}
-
-	// Build resty request
-	req := s.httpClient.R().SetContext(ctx).SetHeaders(upstream.Request.Headers)
-
-	// Build tags value
-	var tagParts []string
-	if len(tags) > 0 {
-		tagParts = append(tagParts, strings.Join(tags, " "))
-	}
-	// Append tags suffix
-	if !raw && strings.TrimSpace(upstream.Defaults.TagsSuffix) != "" {
-		tagParts = append(tagParts, strings.TrimSpace(upstream.Defaults.TagsSuffix))
-	}
-
-	// Set tags query params
-	if len(tagParts) > 0 {
-		req.SetQueryParam(upstream.Request.TagsParam, strings.Join(tagParts, " "))
-	}
-
-	req.
-		SetQueryParam(upstream.Request.LimitParam, strconv.Itoa(limit)).
-		SetQueryParam(upstream.Request.PageParam, strconv.Itoa(page))
+	return upstream, nil
+}
 
-	// optional: Extra Query
-	for k, v := range upstream.Request.ExtraQuery {
-		req.SetQueryParam(k, v)
+func (s *sourceFetchService) Search(ctx context.Context, in FetchInput) (SearchResult, error) {
+	if in.Cursor != "" {
+		return SearchResult{}, fmt.Errorf("%w: cursors are only supported for single-source requests", ErrInvalidCursor)
 	}
-
-	// Exec request
-	resp, err := req.Get(baseURL)
+	sources, err := s.repo.ListEnabled(ctx)
 	if err != nil {
-		return nil, err
+		return SearchResult{}, err
 	}
 
-	if resp.IsError() {
-		return nil, fmt.Errorf("upstream returned status %d", resp.StatusCode())
-	}
+	// Fan out to every enabled source; each call is bounded by its own timeout
+	// so a slow source only costs us its own results.
+	perSource := make([][]domain.Image, len(sources))
+	statuses := make([]SourceStatus, len(sources))
 
-	// Decode JSON
-	body := resp.Body()
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src domain.Source) {
+			defer wg.Done()
 
-	dec := json.NewDecoder(bytes.NewReader(body))
-	dec.UseNumber()
+			start := time.Now()
+			if src.AuthError != "" {
+				statuses[i] = SourceStatus{Source: src.Code, Error: ErrSourceAuthUnavailable.Error()}
+				return
+			}
+			// The query is parsed per source: one strict source rejecting it
+			// only fails that source.
+			res, err := s.fetchFromSource(ctx, src, in.Tags, pagePosition{Page: in.Page}, in.Limit, in.Raw)
 
-	var rawPosts []map[string]any
-	if err := dec.Decode(&rawPosts); err != nil {
-		return nil, fmt.Errorf("failed to decode upstream json: %w", err)
+			status := SourceStatus{
+				Source: src.Code,
+				TookMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				status.Error = ErrorText(err)
+			} else {
+				status.OK = true
+				status.Count = len(res.Images)
+				status.Total = res.Total
+				status.Mapping = &res.Mapping
+				status.Query = &res.Query
+				perSource[i] = res.Images
+			}
+			statuses[i] = status
+		}(i, src)
 	}
+	wg.Wait()
 
-	// Map response to domain.Image
-	images := make([]domain.Image, 0, len(rawPosts))
-	for _, raw := range rawPosts {
-		img, err := mapRawToImage(upstream, raw)
-		if err != nil {
-			continue
-		}
-		images = append(images, img)
+	images := interleaveImages(perSource)
+	merged := len(images)
+	if !in.KeepDuplicates {
+		images = dedupeByMD5(images, sourceRanker(sources, in.Prefer))
 	}
 
-	return images, nil
+	return SearchResult{
+		Images:     images,
+		Sources:    statuses,
+		Duplicates: merged - len(images),
+	}, nil
 }
 
-func mapRawToImage(src domain.Source, raw map[string]any) (domain.Image, error) {
-	m := src.Mapping.Fields
-
-	getVal := func(key string) (any, bool) {
-		v, ok := raw[key]
-		return v, ok
+// interleaveImages merges per-source results round-robin so that no single
+// source dominates the head of the merged list.
+func interleaveImages(perSource [][]domain.Image) []domain.Image {
+	total := 0
+	for _, images := range perSource {
+		total += len(images)
 	}
 
-	getStr := func(key string) (string, bool) {
-		v, ok := getVal(key)
-		if !ok || v == nil {
-			return "", false
-		}
-
-		switch t := v.(type) {
-		case json.Number:
-			// JSON number in string form, e.g. "10317194"
-			return t.String(), true
-		case float64:
-			// Just in case some responses still use float64
-			return strconv.FormatFloat(t, 'f', -1, 64), true
-		default:
-			return fmt.Sprint(t), true
+	out := make([]domain.Image, 0, total)
+	for i := 0; len(out) < total; i++ {
+		for _, images := range perSource {
+			if i < len(images) {
+				out = append(out, images[i])
+			}
 		}
 	}
+	return out
+}
 
-	// Required fields
-	idMapping, ok := m["id"]
-	if !ok || idMapping.Key == "" {
-		return domain.Image{}, errors.New("mapping for 'id' is missing")
+func (s *sourceFetchService) fetchFromSource(ctx context.Context, upstream domain.Source, rawTags []string, pos pagePosition, limit int, raw bool) (FetchResult, error) {
+	if pos.Page <= 0 {
+		pos.Page = 1
 	}
-	fileMapping, ok := m["file_url"]
-	if !ok || fileMapping.Key == "" {
-		return domain.Image{}, errors.New("mapping for 'file_url' is missing")
+	q, err := parseQuery(upstream, rawTags)
+	if err != nil {
+		return FetchResult{}, err
 	}
-
-	// id
-	id, ok := getStr(idMapping.Key)
-	if !ok {
-		return domain.Image{}, fmt.Errorf("id key %q not found in upstream json", idMapping.Key)
+	tags, plan, err := planQuery(upstream, q, pos)
+	if err != nil {
+		return FetchResult{}, err
 	}
-
-	// file_url
-	fileURL, ok := getStr(fileMapping.Key)
-	if !ok {
-		return domain.Image{}, fmt.Errorf("file_url key %q not found in upstream json", fileMapping.Key)
+	req, err := buildSearchRequest(upstream, tags, pos, limit, raw)
+	if err != nil {
+		return FetchResult{}, err
 	}
 
-	// Optional fields
-
-	// created_at
-	var createdAt time.Time
-	if createdMapping, ok := m["created_at"]; ok && createdMapping.Key != "" {
-		if v, ok := getVal(createdMapping.Key); ok {
-			if t, err := parseTimeFlexible(v); err == nil {
-				createdAt = t
-			}
-		}
+	key := searchCacheKey(upstream, tags, req.PageValue, req.Limit, raw)
+	body, cached, err := s.fetchBody(ctx, upstream, req, key)
+	if err != nil {
+		return FetchResult{}, err
 	}
 
-	// image_src_url
-	var source *string
-	if sourceMapping, ok := m["source"]; ok && sourceMapping.Key != "" {
-		if s, ok := getStr(sourceMapping.Key); ok && s != "" {
-			tmp := s
-			source = &tmp
-		}
+	// Decode body and unwrap the post array
+	decoded, err := decodeUpstream(upstream.Request, body)
+	if err != nil {
+		return FetchResult{}, err
 	}
 
-	// rating (string → domain.Rating)
-	var rating domain.Rating
-	if ratingMapping, ok := m["rating"]; ok && ratingMapping.Key != "" {
-		if s, ok := getStr(ratingMapping.Key); ok && s != "" {
-			s = strings.ToLower(s)
-			switch s {
-			case "e", "explicit":
-				rating = domain.RatingExplicit
-			case "q", "questionable":
-				rating = domain.RatingQuestionable
-			case "s", "sensitive":
-				rating = domain.RatingSensitive
-			case "g", "general", "safe":
-				rating = domain.RatingGeneral
-			default:
-			}
-		}
-	}
+	// Map response to domain.Image
+	images, diag := mapPosts(upstream, decoded.Posts)
+	s.proxyMedia(upstream, images)
+
+	// Cached answers were counted when they were fetched.
+	if !cached {
+		s.stats.record(upstream.Code, diag)
+	}
+	if diag.Dropped > 0 {
+		log.Printf("source %s: dropped %d/%d posts during mapping: %v", upstream.Code, diag.Dropped, diag.Received, diag.Reasons)
+	}
+
+	// Id cursors follow the default newest-first order, so any explicit
+	// order falls back to page numbers.
+	byID := upstream.Request.Pagination == domain.PaginationCursor && !q.HasOrder()
+	next, prev := pageCursors(upstream, pos, req.Limit, diag.Received, decoded.Total, images, byID)
+
+	qdiag := QueryDiagnostics{Upstream: strings.Join(tags, " ")}
+	for _, c := range plan.Post {
+		qdiag.PostFilter = append(qdiag.PostFilter, c.String())
+	}
+	mapped := len(images)
+	images = plan.Filter(images)
+	qdiag.Filtered = mapped - len(images)
+
+	return FetchResult{
+		Images:     images,
+		Total:      decoded.Total,
+		Mapping:    diag,
+		Query:      qdiag,
+		Cached:     cached,
+		NextCursor: next,
+		PrevCursor: prev,
+		Page:       req.Page,
+		Limit:      req.Limit,
+		URL:        req.URL,
+	}, nil
+}
 
-	// has_children (bool / "true"/"1")
-	hasChildren := false
-	if hcMapping, ok := m["has_children"]; ok && hcMapping.Key != "" {
-		if v, ok := getVal(hcMapping.Key); ok {
-			hasChildren = toBoolFlexible(v)
+// parseQuery parses tags for src. Sources without capabilities take their
+// native syntax verbatim, so tags the unified syntax rejects (order:rank,
+// score:10..) are passed through rather than refused.
+func parseQuery(src domain.Source, tags []string) (query.Query, error) {
+	q, err := query.Parse(tags)
+	if err != nil {
+		if src.Capabilities == nil {
+			return query.Query{Raw: tags}, nil
 		}
+		return query.Query{}, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
 	}
+	return q, nil
+}
 
-	// parent_id
-	var parentID *string
-	if parentMapping, ok := m["parent_id"]; ok && parentMapping.Key != "" {
-		if s, ok := getStr(parentMapping.Key); ok && s != "" {
-			tmp := s
-			parentID = &tmp
-		}
+// planQuery decides what to send upstream, checking the request against the
+// source's capabilities. Sources without capabilities get the query
+// verbatim, as before the unified syntax existed.
+func planQuery(src domain.Source, q query.Query, pos pagePosition) ([]string, query.Plan, error) {
+	caps := src.Capabilities
+	if caps == nil {
+		return q.Raw, query.Plan{}, nil
 	}
 
-	// md5
-	var md5 string
-	if md5Mapping, ok := m["md5"]; ok && md5Mapping.Key != "" {
-		if s, ok := getStr(md5Mapping.Key); ok {
-			md5 = s
-		}
+	// Id cursors are how clients get past the page cap.
+	if caps.MaxPage > 0 && pos.Page > caps.MaxPage && !pos.byID() {
+		return nil, query.Plan{}, fmt.Errorf("%w: page %d is beyond the source's last page %d", ErrUnsupportedQuery, pos.Page, caps.MaxPage)
 	}
-
-	// tags
-	var tags []string
-	if tagsMapping, ok := m["tags"]; ok && tagsMapping.Key != "" {
-		if v, ok := getVal(tagsMapping.Key); ok {
-			switch t := v.(type) {
-			case string:
-				if t != "" {
-					tags = strings.Fields(t)
-				}
-			case []any:
-				for _, tv := range t {
-					tags = append(tags, fmt.Sprint(tv))
-				}
-			}
-		}
+	plan, err := query.Translate(q, *caps)
+	if err != nil {
+		return nil, query.Plan{}, fmt.Errorf("%w: %v", ErrUnsupportedQuery, err)
 	}
+	return plan.Upstream, plan, nil
+}
 
-	// preview_url
-	var preview string
-	if previewMapping, ok := m["preview_url"]; ok && previewMapping.Key != "" {
-		if s, ok := getStr(previewMapping.Key); ok {
-			preview = s
-		}
+// proxyMedia points image URLs at the media proxy when src asks for it.
+func (s *sourceFetchService) proxyMedia(src domain.Source, images []domain.Image) {
+	if s.media == nil || !src.Mapping.ProxyMedia {
+		return
 	}
-
-	// sample_url
-	var sample string
-	if sampleMapping, ok := m["sample_url"]; ok && sampleMapping.Key != "" {
-		if s, ok := getStr(sampleMapping.Key); ok {
-			sample = s
-		}
+	for i := range images {
+		s.media.Rewrite(src, &images[i])
 	}
-
-	return domain.Image{
-		ID:          id,
-		Upstream:    src.Code,
-		CreatedAt:   createdAt,
-		Source:      source,
-		Rating:      rating,
-		Tags:        tags,
-		HasChildren: hasChildren,
-		ParentID:    parentID,
-		MD5:         md5,
-		PreviewURL:  preview,
-		SampleURL:   sample,
-		FileURL:     fileURL,
-	}, nil
 }
 
-func parseTimeFlexible(v any) (time.Time, error) {
-	switch t := v.(type) {
-	case string:
-		t = strings.TrimSpace(t)
-		if t == "" {
-			return time.Time{}, fmt.Errorf("empty time string")
-		}
-		// try RFC3339 format (2023-10-01T12:34:56Z)
-		if ts, err := time.Parse(time.RFC3339, t); err == nil {
-			return ts, nil
-		}
-		// try unix format
-		if unix, err := strconv.ParseInt(t, 10, 64); err == nil {
-			return time.Unix(unix, 0).UTC(), nil
-		}
-		return time.Time{}, fmt.Errorf("unsupported time string %q", t)
-	case float64:
-		// typical JSON number → float64
-		return time.Unix(int64(t), 0).UTC(), nil
-	case int64:
-		return time.Unix(t, 0).UTC(), nil
-	case int:
-		return time.Unix(int64(t), 0).UTC(), nil
-	default:
-		return time.Time{}, fmt.Errorf("unsupported time type %T", v)
-	}
+func (s *sourceFetchService) MappingStats() []MappingStats {
+	return s.stats.snapshot()
 }
 
-func toBoolFlexible(v any) bool {
-	switch t := v.(type) {
-	case bool:
-		return t
-	case string:
-		s := strings.ToLower(strings.TrimSpace(t))
-		return s == "true" || s == "1" || s == "yes"
-	case float64:
-		return t != 0
-	case int:
-		return t != 0
-	case int64:
-		return t != 0
-	default:
-		return false
-	}
+func (s *sourceFetchService) BreakerStates() []breaker.Snapshot {
+	return s.breakers.Snapshot()
 }
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+const defaultProbeRecords = 5
+
+// ProbeInput describes a dry run of a source config. When Sample is set it
+// is used as the upstream body instead of calling the upstream. For XML
+// sources Sample may be a JSON string holding the document.
+type ProbeInput struct {
+	Sample     json.RawMessage
+	Tags       []string
+	Page       int
+	Limit      int
+	Raw        bool
+	MaxRecords int
+}
+
+// ProbeResult is everything a dry run found out. Error is set when the
+// upstream call or decoding failed; URL is always filled in.
+type ProbeResult struct {
+	URL     string             `json:"url"`
+	Live    bool               `json:"live"`
+	Error   string             `json:"error,omitempty"`
+	Total   *int               `json:"total,omitempty"`
+	Mapping MappingDiagnostics `json:"mapping"`
+	Records []ProbeRecord      `json:"records"`
+}
+
+// ProbeRecord shows how one upstream record was mapped.
+type ProbeRecord struct {
+	Raw    map[string]any    `json:"raw"`
+	Image  *domain.Image     `json:"image,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Fields []FieldResolution `json:"fields"`
+}
+
+// FieldResolution explains how a single mapped field was resolved.
+type FieldResolution struct {
+	Field  string   `json:"field"`
+	Key    string   `json:"key,omitempty"`
+	Found  bool     `json:"found"`
+	Raw    any      `json:"raw,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Probe runs src through the same request building, decoding and mapping as
+// a real fetch without persisting anything or touching the mapping stats.
+func (s *sourceFetchService) Probe(ctx context.Context, src domain.Source, in ProbeInput) (ProbeResult, error) {
+	q, err := parseQuery(src, in.Tags)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	pos := pagePosition{Page: max(in.Page, 1)}
+	tags, _, err := planQuery(src, q, pos)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+
+	req, err := buildSearchRequest(src, tags, pos, in.Limit, in.Raw)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	out := ProbeResult{URL: req.URL, Records: []ProbeRecord{}}
+
+	var body []byte
+	if len(in.Sample) > 0 {
+		body, err = sampleBody(in.Sample)
+		if err != nil {
+			return ProbeResult{}, err
+		}
+	} else {
+		out.Live = true
+		// A single attempt, outside the breaker: a dry run of an unsaved
+		// config should neither retry nor trip the real source's breaker.
+		body, err = s.doRequest(ctx, src, req)
+		if err != nil {
+			out.Error = ErrorText(err)
+			return out, nil
+		}
+	}
+
+	decoded, err := decodeUpstream(src.Request, body)
+	if err != nil {
+		out.Error = ErrorText(err)
+		return out, nil
+	}
+	out.Total = decoded.Total
+	_, out.Mapping = mapPosts(src, decoded.Posts)
+
+	limit := in.MaxRecords
+	if limit <= 0 {
+		limit = defaultProbeRecords
+	}
+	for i, raw := range decoded.Posts {
+		if i >= limit {
+			break
+		}
+
+		rec := ProbeRecord{Raw: raw, Fields: describeFields(src, raw)}
+		if img, err := mapRawToImage(src, raw); err != nil {
+			rec.Error = ErrorText(err)
+		} else {
+			rec.Image = &img
+		}
+		out.Records = append(out.Records, rec)
+	}
+
+	return out, nil
+}
+
+func sampleBody(sample json.RawMessage) ([]byte, error) {
+	trimmed := strings.TrimSpace(string(sample))
+	if !strings.HasPrefix(trimmed, `"`) {
+		return []byte(trimmed), nil
+	}
+
+	var doc string
+	if err := json.Unmarshal(sample, &doc); err != nil {
+		return nil, validationError("sample must be a json document or a json string")
+	}
+	return []byte(doc), nil
+}
+
+// describeFields resolves every mapped field of raw, in field name order.
+func describeFields(src domain.Source, raw map[string]any) []FieldResolution {
+	names := make([]string, 0, len(src.Mapping.Fields))
+	for name := range src.Mapping.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r := fieldResolver{src: src, raw: raw}
+	out := make([]FieldResolution, 0, len(names))
+	for _, name := range names {
+		fm := src.Mapping.Fields[name]
+		res := FieldResolution{Field: name, Key: fm.Key}
+		if fm.Key != "" {
+			res.Raw, _ = lookupPath(raw, fm.Key)
+		}
+		res.Values, res.Found = r.strs(name)
+		out = append(out, res)
+	}
+	return out
+}
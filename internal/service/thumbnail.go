@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/freikugel0/boorumesh-be/internal/media"
+)
+
+// thumbTimeout bounds fetching and resizing one thumbnail.
+const thumbTimeout = 30 * time.Second
+
+type thumbnail struct {
+	data        []byte
+	contentType string
+}
+
+// Thumbnail serves a scaled-down copy of req.Target, from the disk cache
+// when it has one. Concurrent requests for the same thumbnail share one
+// fetch and resize, and only a few images are decoded at a time.
+func (s *mediaService) Thumbnail(ctx context.Context, req media.ThumbRequest) (*MediaStream, error) {
+	src, err := s.mediaSource(ctx, req.Code, req.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := media.URLKey(req.Target.String() + "#w=" + strconv.Itoa(req.Width))
+	if req.Key != "" {
+		cacheKey = req.Key + strconv.Itoa(req.Width)
+	}
+	if out, ok := s.openCached(req.Code, cacheKey); ok {
+		return out, nil
+	}
+
+	ch := s.inflight.DoChan(req.Code+"/"+cacheKey, func() (any, error) {
+		// Detached from the caller so one client going away does not fail
+		// everyone else waiting on this thumbnail.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), thumbTimeout)
+		defer cancel()
+
+		in, _, err := s.fetch(ctx, src, req.Target, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer in.Body.Close()
+
+		select {
+		case s.decodeSlots <- struct{}{}:
+			defer func() { <-s.decodeSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		data, contentType, err := media.Thumbnail(in.Body, req.Width)
+		if err != nil {
+			return nil, err
+		}
+		if s.cache != nil {
+			s.storeThumbnail(req.Code, cacheKey, req.Target.String(), data, contentType)
+		}
+		return thumbnail{data: data, contentType: contentType}, nil
+	})
+
+	var thumb thumbnail
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		thumb = res.Val.(thumbnail)
+	}
+	return &MediaStream{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":   {thumb.contentType},
+			"Content-Length": {strconv.Itoa(len(thumb.data))},
+		},
+		Body: io.NopCloser(bytes.NewReader(thumb.data)),
+	}, nil
+}
+
+func (s *mediaService) storeThumbnail(code, key, url string, data []byte, contentType string) {
+	w, err := s.cache.Create(code, key, media.CacheMeta{ContentType: contentType, URL: url})
+	if err == nil {
+		if _, err = w.Write(data); err == nil {
+			err = w.Commit()
+		} else {
+			w.Abort()
+		}
+	}
+	if err != nil {
+		log.Printf("media cache %s: %v", code, err)
+	}
+}
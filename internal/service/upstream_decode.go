@@ -0,0 +1,221 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+// upstreamPage is a decoded upstream response: the post records plus any
+// envelope metadata we know how to extract.
+type upstreamPage struct {
+	Posts []map[string]any
+	Total *int
+}
+
+func decodeUpstream(cfg domain.RequestConfig, body []byte) (upstreamPage, error) {
+	var (
+		doc any
+		err error
+	)
+	switch cfg.ResponseFormat {
+	case domain.ResponseFormatXML:
+		doc, err = decodeXMLDocument(body)
+		if err != nil {
+			return upstreamPage{}, fmt.Errorf("failed to decode upstream xml: %w", err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return upstreamPage{}, fmt.Errorf("failed to decode upstream json: %w", err)
+		}
+	}
+
+	return extractPage(cfg, doc)
+}
+
+// decodeXMLDocument turns an XML document into the same generic shape as a
+// decoded JSON body. The root element becomes an object in which:
+//
+//   - attributes become string values (<post id="1"> → {"id": "1"})
+//   - child elements become values keyed by element name, and repeated
+//     elements become arrays (<posts><post/><post/></posts> → {"post": [...]})
+//   - an element with only text becomes a string; text next to attributes or
+//     children is kept under "#text"
+//
+// Attributes win over child elements of the same name.
+func decodeXMLDocument(body []byte) (any, error) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Entity = xml.HTMLEntity
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("document has no root element")
+			}
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return decodeXMLElement(dec, start)
+		}
+	}
+}
+
+func decodeXMLElement(dec *xml.Decoder, start xml.StartElement) (any, error) {
+	obj := make(map[string]any, len(start.Attr))
+	for _, attr := range start.Attr {
+		obj[attr.Name.Local] = attr.Value
+	}
+
+	var (
+		text        strings.Builder
+		hasChildren bool
+	)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			hasChildren = true
+			child, err := decodeXMLElement(dec, t)
+			if err != nil {
+				return nil, err
+			}
+
+			name := t.Name.Local
+			switch existing := obj[name].(type) {
+			case nil:
+				obj[name] = child
+			case []any:
+				obj[name] = append(existing, child)
+			default:
+				if !isXMLAttr(start, name) {
+					obj[name] = []any{existing, child}
+				}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			content := strings.TrimSpace(text.String())
+			if len(start.Attr) == 0 && !hasChildren {
+				return content, nil
+			}
+			if content != "" {
+				obj["#text"] = content
+			}
+			return obj, nil
+		}
+	}
+}
+
+func isXMLAttr(start xml.StartElement, name string) bool {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == name {
+			return true
+		}
+	}
+	return false
+}
+
+// extractPage locates the post array inside a decoded document using
+// RequestConfig.ResponseRoot and reads envelope metadata such as totals.
+func extractPage(cfg domain.RequestConfig, doc any) (upstreamPage, error) {
+	var page upstreamPage
+
+	root := strings.TrimSpace(cfg.ResponseRoot)
+	posts := doc
+	if root != "" {
+		envelope, ok := doc.(map[string]any)
+		if !ok {
+			return upstreamPage{}, fmt.Errorf("expected upstream envelope object for response_root %q, got %s", root, jsonKind(doc))
+		}
+
+		// Several boorus omit the post array entirely when nothing matched.
+		v, found := lookupPath(envelope, root)
+		if !found || v == nil {
+			posts = []any{}
+		} else {
+			posts = v
+		}
+
+		if cfg.TotalPath != "" {
+			if v, ok := lookupPath(envelope, cfg.TotalPath); ok {
+				if n, ok := toIntFlexible(v); ok {
+					page.Total = &n
+				}
+			}
+		}
+	}
+
+	switch t := posts.(type) {
+	case []any:
+		page.Posts = make([]map[string]any, 0, len(t))
+		for _, item := range t {
+			if rec, ok := item.(map[string]any); ok {
+				page.Posts = append(page.Posts, rec)
+			}
+		}
+	case map[string]any:
+		// A lone post where a list was expected (e.g. single-result envelopes).
+		page.Posts = []map[string]any{t}
+	default:
+		if root == "" {
+			return upstreamPage{}, fmt.Errorf("expected upstream post array, got %s (set request.response_root for enveloped responses)", jsonKind(posts))
+		}
+		return upstreamPage{}, fmt.Errorf("expected post array at %q, got %s", root, jsonKind(posts))
+	}
+
+	return page, nil
+}
+
+func jsonKind(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return "number"
+	}
+}
+
+func toIntFlexible(v any) (int, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return int(n), true
+		}
+		if f, err := t.Float64(); err == nil {
+			return int(f), true
+		}
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(t)); err == nil {
+			return n, true
+		}
+	case float64:
+		return int(t), true
+	case int:
+		return t, true
+	case int64:
+		return int(t), true
+	}
+	return 0, false
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/freikugel0/boorumesh-be/internal/cache"
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+	"github.com/freikugel0/boorumesh-be/internal/ratelimit"
+)
+
+// upstreamRequest is a fully built call to a source's API.
+type upstreamRequest struct {
+	URL     string
+	Headers map[string]string
+	Page    int
+	Limit   int // after clamping to Defaults.MaxLimit
+	// PageValue is what was sent in RequestConfig.PageParam.
+	PageValue string
+}
+
+// UpstreamStatusError is returned when the upstream answers with a non-2xx status.
+type UpstreamStatusError struct {
+	StatusCode int
+	// RetryAfter is the upstream's Retry-After hint, if it sent one.
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.StatusCode)
+}
+
+// buildSearchRequest turns a search into the upstream URL for src.
+func buildSearchRequest(src domain.Source, tags []string, pos pagePosition, limit int, raw bool) (upstreamRequest, error) {
+	// Apply default limit / page
+	if pos.Page <= 0 {
+		pos.Page = 1
+	}
+	maxLimit := src.Defaults.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = 100
+	}
+	if limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+
+	// Build base URL: base_url + posts_path
+	u, err := url.Parse(strings.TrimRight(src.BaseURL, "/") + "/" + strings.TrimLeft(src.Request.PostsPath, "/"))
+	if err != nil {
+		return upstreamRequest{}, fmt.Errorf("invalid upstream url: %w", err)
+	}
+	q := u.Query()
+
+	// Build tags value
+	var tagParts []string
+	if len(tags) > 0 {
+		tagParts = append(tagParts, strings.Join(tags, " "))
+	}
+	// Append tags suffix
+	if !raw && strings.TrimSpace(src.Defaults.TagsSuffix) != "" {
+		tagParts = append(tagParts, strings.TrimSpace(src.Defaults.TagsSuffix))
+	}
+
+	// Set tags query params
+	if len(tagParts) > 0 {
+		q.Set(src.Request.TagsParam, strings.Join(tagParts, " "))
+	}
+
+	q.Set(src.Request.LimitParam, strconv.Itoa(limit))
+	pageValue := pageParamValue(src, pos, limit)
+	q.Set(src.Request.PageParam, pageValue)
+
+	// optional: Extra Query
+	for k, v := range src.Request.ExtraQuery {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+
+	return upstreamRequest{
+		URL:       u.String(),
+		Headers:   src.Request.Headers,
+		Page:      pos.Page,
+		Limit:     limit,
+		PageValue: pageValue,
+	}, nil
+}
+
+// RateLimitedError is returned when the source's outbound rate limit is
+// exhausted. RetryAfter estimates when a request would be let through.
+type RateLimitedError struct {
+	Source     domain.SourceCode
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limit for source %s exceeded, retry after %s", e.Source, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *RateLimitedError) Is(target error) bool { return target == ErrRateLimited }
+
+// upstreamTimeout is how long one upstream call may take: the source's
+// timeout_ms, or the HTTP client's own limit when that is unset.
+func upstreamTimeout(src domain.Source) time.Duration {
+	if src.Defaults.TimeoutMS > 0 {
+		return time.Duration(src.Defaults.TimeoutMS) * time.Millisecond
+	}
+	return clientTimeout
+}
+
+// throttle applies the source's outbound rate limit before an upstream call.
+func (s *sourceFetchService) throttle(ctx context.Context, src domain.Source, req upstreamRequest) error {
+	rl := src.Defaults.RateLimit
+	if rl == nil || rl.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	key := "source:" + string(src.Code)
+	if rl.PerHost {
+		if u, err := url.Parse(req.URL); err == nil {
+			key = "host:" + u.Host
+		}
+	}
+	bucket := s.limiters.Bucket(key, string(src.Code), rl.RequestsPerSecond, rl.Burst)
+
+	if rl.Mode == domain.RateLimitReject {
+		if ok, retryAfter := bucket.TryTake(); !ok {
+			return &RateLimitedError{Source: src.Code, RetryAfter: retryAfter}
+		}
+		return nil
+	}
+
+	maxWait := time.Duration(rl.MaxWaitMS) * time.Millisecond
+	if maxWait <= 0 {
+		maxWait = upstreamTimeout(src)
+	}
+	retryAfter, err := bucket.Wait(ctx, maxWait)
+	if errors.Is(err, ratelimit.ErrLimited) {
+		return &RateLimitedError{Source: src.Code, RetryAfter: retryAfter}
+	}
+	return err
+}
+
+// doRequest performs a single upstream attempt: rate limit, then the HTTP
+// call bounded by the source timeout.
+func (s *sourceFetchService) doRequest(ctx context.Context, src domain.Source, req upstreamRequest) ([]byte, error) {
+	if err := s.throttle(ctx, src, req); err != nil {
+		return nil, err
+	}
+
+	// Context with timeout per-source
+	if src.Defaults.TimeoutMS > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, upstreamTimeout(src))
+		defer cancel()
+	}
+
+	r := s.httpClient.R().
+		SetContext(ctx).
+		SetHeaders(req.Headers)
+	applyAuth(r, src.Auth)
+
+	resp, err := r.Get(req.URL)
+	if err != nil {
+		// Transport errors quote the URL, credentials included.
+		return nil, sanitizeError(err, src.Auth)
+	}
+
+	if resp.IsError() {
+		return nil, &UpstreamStatusError{
+			StatusCode: resp.StatusCode(),
+			RetryAfter: parseRetryAfter(resp.Header().Get("Retry-After")),
+		}
+	}
+
+	return resp.Body(), nil
+}
+
+// applyAuth adds the source's credentials to an outgoing request. They are
+// applied here rather than in upstreamRequest.URL so that built URLs can be
+// shown and logged without leaking secrets.
+func applyAuth(r *resty.Request, auth *domain.SourceAuth) {
+	if auth == nil {
+		return
+	}
+
+	switch auth.Scheme {
+	case domain.AuthBasic:
+		r.SetBasicAuth(auth.Username, auth.Password)
+	case domain.AuthQuery:
+		if auth.UserParam != "" {
+			r.SetQueryParam(auth.UserParam, auth.Username)
+		}
+		r.SetQueryParam(auth.KeyParam, auth.Token)
+	case domain.AuthBearer:
+		r.SetAuthToken(auth.Token)
+	case domain.AuthHeader:
+		r.SetHeader(auth.HeaderName, auth.Token)
+	}
+}
+
+// fetchBody returns the upstream body for req, served from the response
+// cache when the source enables it. Concurrent calls with the same key share
+// a single upstream request. The bool reports a cache hit.
+func (s *sourceFetchService) fetchBody(ctx context.Context, src domain.Source, req upstreamRequest, key string) ([]byte, bool, error) {
+	ttl := time.Duration(src.Defaults.CacheTTLMS) * time.Millisecond
+	useCache := s.cache != nil && ttl > 0
+
+	if useCache {
+		body, ok, err := s.cache.Get(ctx, key)
+		if err != nil {
+			log.Printf("source %s: cache get failed: %v", src.Code, err)
+		} else if ok {
+			return body, true, nil
+		}
+	}
+
+	ch := s.inflight.DoChan(key, func() (any, error) {
+		// Detached from the caller so one client going away does not fail
+		// everyone else waiting on this call; the source timeout still applies.
+		detached := context.WithoutCancel(ctx)
+
+		body, err := s.getUpstream(detached, src, req)
+		if err != nil {
+			return nil, err
+		}
+		if useCache {
+			opts := cache.Options{
+				Namespace:  string(src.Code),
+				TTL:        ttl,
+				MaxEntries: src.Defaults.CacheMaxEntries,
+			}
+			if err := s.cache.Set(detached, key, body, opts); err != nil {
+				log.Printf("source %s: cache set failed: %v", src.Code, err)
+			}
+		}
+		return body, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, false, res.Err
+		}
+		return res.Val.([]byte), false, nil
+	}
+}
+
+// searchCacheKey identifies a search for caching and request coalescing.
+// The source version is part of the key so config changes take effect
+// immediately instead of after the TTL.
+func searchCacheKey(src domain.Source, tags []string, pageValue string, limit int, raw bool) string {
+	norm := make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if _, dup := seen[t]; dup || t == "" {
+			continue
+		}
+		seen[t] = struct{}{}
+		norm = append(norm, t)
+	}
+	sort.Strings(norm)
+
+	return fmt.Sprintf("search:%s:%d:%s:%s:%d:%t",
+		src.Code, src.UpdatedAt.UnixMicro(), strings.Join(norm, " "), pageValue, limit, raw)
+}
+
+// mapPosts maps decoded records to images, collecting why any were dropped.
+func mapPosts(src domain.Source, posts []map[string]any) ([]domain.Image, MappingDiagnostics) {
+	diag := MappingDiagnostics{Received: len(posts)}
+	images := make([]domain.Image, 0, len(posts))
+	for _, raw := range posts {
+		img, err := mapRawToImage(src, raw)
+		if err != nil {
+			diag.recordDrop(err)
+			continue
+		}
+		images = append(images, img)
+	}
+	diag.Mapped = len(images)
+
+	return images, diag
+}
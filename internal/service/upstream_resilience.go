@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freikugel0/boorumesh-be/internal/breaker"
+	"github.com/freikugel0/boorumesh-be/internal/domain"
+)
+
+var (
+	defaultRetryStatuses = []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+	defaultRetryBaseDelay = 200 * time.Millisecond
+	defaultRetryMaxDelay  = 5 * time.Second
+
+	defaultBreakerThreshold = 5
+	defaultBreakerOpenFor   = 30 * time.Second
+)
+
+// CircuitOpenError is returned while a source's circuit breaker is open.
+type CircuitOpenError struct {
+	Source     domain.SourceCode
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("source %s is temporarily unavailable (circuit open), retry after %s", e.Source, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *CircuitOpenError) Is(target error) bool { return target == ErrCircuitOpen }
+
+// getUpstream executes req behind the source's circuit breaker, retrying
+// according to its retry policy, and returns the body.
+func (s *sourceFetchService) getUpstream(ctx context.Context, src domain.Source, req upstreamRequest) ([]byte, error) {
+	br := s.breakers.Get(string(src.Code), breakerConfig(src.Defaults.Breaker))
+	if ok, retryAfter := br.Allow(); !ok {
+		return nil, &CircuitOpenError{Source: src.Code, RetryAfter: retryAfter}
+	}
+
+	body, err := s.doWithRetry(ctx, src, req)
+	switch {
+	case err == nil:
+		br.Success()
+	case countsAsUpstreamFailure(ctx, err):
+		br.Failure(sanitizeError(err, src.Auth))
+	default:
+		br.Ignore()
+	}
+	return body, err
+}
+
+func (s *sourceFetchService) doWithRetry(ctx context.Context, src domain.Source, req upstreamRequest) ([]byte, error) {
+	policy := src.Defaults.Retry
+	maxAttempts := 1
+	if policy != nil && policy.MaxAttempts > 1 {
+		maxAttempts = policy.MaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		body, err := s.doRequest(ctx, src, req)
+		if err == nil || attempt >= maxAttempts || !retryable(ctx, policy, err) {
+			return body, err
+		}
+
+		delay, ok := retryDelay(policy, attempt, err)
+		if !ok {
+			return nil, err
+		}
+		if deadline, has := ctx.Deadline(); has && time.Until(deadline) < delay {
+			return nil, err
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+func retryable(ctx context.Context, policy *domain.RetryPolicy, err error) bool {
+	if policy == nil || ctx.Err() != nil || errors.Is(err, ErrRateLimited) {
+		return false
+	}
+
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		statuses := defaultRetryStatuses
+		if len(policy.RetryStatuses) > 0 {
+			statuses = policy.RetryStatuses
+		}
+		return slices.Contains(statuses, statusErr.StatusCode)
+	}
+
+	// Transport errors and per-attempt timeouts.
+	return true
+}
+
+// retryDelay computes exponential backoff with jitter for the given attempt.
+// It returns false when the upstream asks us to wait longer than the policy
+// allows, in which case retrying is pointless.
+func retryDelay(policy *domain.RetryPolicy, attempt int, err error) (time.Duration, bool) {
+	base := defaultRetryBaseDelay
+	if policy.BaseDelayMS > 0 {
+		base = time.Duration(policy.BaseDelayMS) * time.Millisecond
+	}
+	maxDelay := defaultRetryMaxDelay
+	if policy.MaxDelayMS > 0 {
+		maxDelay = time.Duration(policy.MaxDelayMS) * time.Millisecond
+	}
+
+	delay := base << (attempt - 1)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	// Jitter in [delay/2, delay] spreads out retries from concurrent callers.
+	delay = delay/2 + rand.N(delay/2+1)
+
+	var statusErr *UpstreamStatusError
+	if policy.RespectRetryAfter && errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		if statusErr.RetryAfter > maxDelay {
+			return 0, false
+		}
+		delay = statusErr.RetryAfter
+	}
+	return delay, true
+}
+
+// countsAsUpstreamFailure decides whether an error says the upstream is
+// unhealthy. Client cancellations, our own rate limiting and ordinary 4xx
+// answers do not.
+func countsAsUpstreamFailure(ctx context.Context, err error) bool {
+	if errors.Is(err, ErrRateLimited) || errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func breakerConfig(cfg *domain.BreakerConfig) breaker.Config {
+	out := breaker.Config{
+		FailureThreshold: defaultBreakerThreshold,
+		OpenFor:          defaultBreakerOpenFor,
+	}
+	if cfg != nil {
+		if cfg.FailureThreshold > 0 {
+			out.FailureThreshold = cfg.FailureThreshold
+		}
+		if cfg.OpenMS > 0 {
+			out.OpenFor = time.Duration(cfg.OpenMS) * time.Millisecond
+		}
+	}
+	return out
+}
+
+// parseRetryAfter reads a Retry-After header in either delta-seconds or
+// HTTP-date form.
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}